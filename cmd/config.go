@@ -3,39 +3,76 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/user"
 	"reflect"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/merzzzl/warp/internal/protocol/group"
+	"github.com/merzzzl/warp/internal/protocol/httpproxy"
+	"github.com/merzzzl/warp/internal/protocol/shadowsocks"
+	"github.com/merzzzl/warp/internal/protocol/socks4"
 	"github.com/merzzzl/warp/internal/protocol/socks5"
 	"github.com/merzzzl/warp/internal/protocol/ssh"
 	"github.com/merzzzl/warp/internal/protocol/wg"
 	"github.com/merzzzl/warp/internal/service"
 )
 
-var errInvalidConfig = errors.New("invalid config of protocols")
+var (
+	errInvalidConfig  = errors.New("invalid config of protocols")
+	errUnknownCommand = errors.New("unknown command")
+	errDuplicateName  = errors.New("duplicate protocol name")
+	errUnknownDep     = errors.New("via or group member names an unknown protocol")
+	errCycle          = errors.New("protocols depend on each other")
+	errGroupVia       = errors.New("group can not be dialed via another protocol")
+	errViaUDP         = errors.New("wireguard and shadowsocks need udp via their chain")
+)
 
 type ConfigProtocol struct {
-	SSH       *ssh.Config    `yaml:"ssh"`
-	SOCKS5    *socks5.Config `yaml:"socks5"`
-	WireGuard *wg.Config     `yaml:"wireguard"`
+	Name        string              `yaml:"name"`
+	Via         string              `yaml:"via"`
+	SSH         *ssh.Config         `yaml:"ssh"`
+	SOCKS5      *socks5.Config      `yaml:"socks5"`
+	SOCKS4      *socks4.Config      `yaml:"socks4"`
+	HTTP        *httpproxy.Config   `yaml:"http"`
+	Shadowsocks *shadowsocks.Config `yaml:"shadowsocks"`
+	WireGuard   *wg.Config          `yaml:"wireguard"`
+	Group       *group.Config       `yaml:"group"`
 }
 
 type Config struct {
-	Tunnel    *service.Config  `yaml:"tunnel"`
-	Protocols []ConfigProtocol `yaml:"protocols"`
-	ipv6      bool             `yaml:"ipv6"`
+	Tunnel    *service.Config      `yaml:"tunnel"`
+	Protocols []ConfigProtocol     `yaml:"protocols"`
+	Rules     []service.RuleConfig `yaml:"rules"`
+	IPv6      bool                 `yaml:"ipv6"`
 	verbose   bool
 	debug     bool
 	fun       bool
+	cleanup   bool
 }
 
 func loadConfig() (*Config, error) {
 	var cfg Config
 
+	flag.BoolVar(&cfg.verbose, "verbose", false, "enable verbose logging (default: disabled)")
+	flag.BoolVar(&cfg.debug, "debug", false, "enable debug logging (default: disabled)")
+	flag.BoolVar(&cfg.fun, "fun", false, "magic!")
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "":
+	case "cleanup":
+		cfg.cleanup = true
+
+		return &cfg, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownCommand, flag.Arg(0))
+	}
+
 	name, _ := os.LookupEnv("SUDO_USER")
 
 	usr, err := user.Lookup(name)
@@ -43,11 +80,6 @@ func loadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	flag.BoolVar(&cfg.verbose, "verbose", false, "enable verbose logging (default: disabled)")
-	flag.BoolVar(&cfg.debug, "debug", false, "enable debug logging (default: disabled)")
-	flag.BoolVar(&cfg.fun, "fun", false, "magic!")
-	flag.Parse()
-
 	file, err := os.ReadFile(usr.HomeDir + "/" + ".warp.yaml")
 	if err != nil {
 		return nil, err
@@ -57,10 +89,12 @@ func loadConfig() (*Config, error) {
 		return nil, err
 	}
 
-	if !cfg.validate() {
-		return nil, errInvalidConfig
+	if err := cfg.validate(); err != nil {
+		return nil, err
 	}
 
+	cfg.defaults()
+
 	for _, pConfig := range cfg.Protocols {
 		if pConfig.SSH != nil {
 			if strings.Contains(pConfig.SSH.User, "radik") {
@@ -74,14 +108,185 @@ func loadConfig() (*Config, error) {
 	return &cfg, nil
 }
 
-func (c *Config) validate() bool {
+// defaults makes protocols without their own ipv6 option follow the global one.
+func (c *Config) defaults() {
 	for _, p := range c.Protocols {
+		switch {
+		case p.SSH != nil && p.SSH.IPv6 == nil:
+			p.SSH.IPv6 = &c.IPv6
+		case p.SOCKS5 != nil && p.SOCKS5.IPv6 == nil:
+			p.SOCKS5.IPv6 = &c.IPv6
+		case p.SOCKS4 != nil && p.SOCKS4.IPv6 == nil:
+			p.SOCKS4.IPv6 = &c.IPv6
+		case p.HTTP != nil && p.HTTP.IPv6 == nil:
+			p.HTTP.IPv6 = &c.IPv6
+		case p.Shadowsocks != nil && p.Shadowsocks.IPv6 == nil:
+			p.Shadowsocks.IPv6 = &c.IPv6
+		case p.WireGuard != nil && p.WireGuard.IPv6 == nil:
+			p.WireGuard.IPv6 = &c.IPv6
+		case p.Group != nil && p.Group.IPv6 == nil:
+			p.Group.IPv6 = &c.IPv6
+		}
+	}
+}
+
+// validate checks that every protocol sets exactly one kind, that via and
+// group members name existing protocols without a cycle, that protocols needing
+// udp are not chained through one that can not carry it and that the rules parse.
+func (c *Config) validate() error {
+	// Only the names are needed to check the rules, the protocols do not exist yet.
+	names := make(map[string]service.Protocol, len(c.Protocols))
+
+	for i, p := range c.Protocols {
 		if !p.validate() {
-			return false
+			return fmt.Errorf("%w: protocol %d", errInvalidConfig, i)
 		}
+
+		if p.Group != nil && p.Via != "" {
+			return fmt.Errorf("%w: %s", errGroupVia, p.Name)
+		}
+
+		if p.Name == "" {
+			continue
+		}
+
+		if _, ok := names[p.Name]; ok {
+			return fmt.Errorf("%w: %s", errDuplicateName, p.Name)
+		}
+
+		names[p.Name] = nil
+	}
+
+	for _, p := range c.Protocols {
+		for _, dep := range p.deps() {
+			if _, ok := names[dep]; !ok {
+				return fmt.Errorf("%w: %s", errUnknownDep, dep)
+			}
+		}
+	}
+
+	if _, err := c.order(); err != nil {
+		return err
+	}
+
+	for _, p := range c.Protocols {
+		if p.Via == "" || (p.WireGuard == nil && p.Shadowsocks == nil) {
+			continue
+		}
+
+		if blocker := c.noUDP(p.Via); blocker != "" {
+			return fmt.Errorf("%w: %s via %s, %s can not carry udp", errViaUDP, p.Name, p.Via, blocker)
+		}
+	}
+
+	if _, err := service.NewRules(c.Rules, names); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// index returns the position of the protocol called name.
+func (c *Config) index(name string) int {
+	for i, p := range c.Protocols {
+		if p.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// order returns the positions of the protocols so that each comes after the
+// ones it is dialed through or groups, names must exist.
+func (c *Config) order() ([]int, error) {
+	const (
+		visiting = 1
+		added    = 2
+	)
+
+	order := make([]int, 0, len(c.Protocols))
+	state := make([]int, len(c.Protocols))
+	path := []string{}
+
+	var add func(i int) error
+
+	add = func(i int) error {
+		path = append(path, c.Protocols[i].Name)
+		defer func() { path = path[:len(path)-1] }()
+
+		switch state[i] {
+		case added:
+			return nil
+		case visiting:
+			cycle := path[slices.Index(path, c.Protocols[i].Name):]
+
+			return fmt.Errorf("%w: %s", errCycle, strings.Join(cycle, " -> "))
+		}
+
+		state[i] = visiting
+
+		for _, dep := range c.Protocols[i].deps() {
+			if err := add(c.index(dep)); err != nil {
+				return err
+			}
+		}
+
+		state[i] = added
+		order = append(order, i)
+
+		return nil
+	}
+
+	for i := range c.Protocols {
+		if err := add(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// noUDP returns the first protocol on the way through the protocol called name
+// that can not dial udp, or an empty string. Only wireguard, socks5 and
+// shadowsocks carry udp, through their own via, and a group only if all of its
+// members do. The names must exist without a cycle.
+func (c *Config) noUDP(name string) string {
+	p := c.Protocols[c.index(name)]
+
+	switch {
+	case p.Group != nil:
+		for _, member := range p.Group.Members {
+			if blocker := c.noUDP(member); blocker != "" {
+				return blocker
+			}
+		}
+
+		return ""
+	case p.WireGuard != nil || p.SOCKS5 != nil || p.Shadowsocks != nil:
+		if p.Via == "" {
+			return ""
+		}
+
+		return c.noUDP(p.Via)
+	default:
+		return name
+	}
+}
+
+// deps returns the names of the protocols p needs to be created.
+func (c *ConfigProtocol) deps() []string {
+	var deps []string
+
+	if c.Via != "" {
+		deps = append(deps, c.Via)
+	}
+
+	if c.Group != nil {
+		deps = append(deps, c.Group.Members...)
 	}
 
-	return true
+	return deps
 }
 
 func (c *ConfigProtocol) validate() bool {
@@ -94,7 +299,7 @@ func (c *ConfigProtocol) validate() bool {
 
 	for i := 0; i < v.NumField(); i++ {
 		field := v.Field(i)
-		if field.IsValid() && !field.IsNil() {
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
 			if find {
 				return false
 			}
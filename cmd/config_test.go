@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/merzzzl/warp/internal/protocol/group"
+	"github.com/merzzzl/warp/internal/protocol/httpproxy"
+	"github.com/merzzzl/warp/internal/protocol/shadowsocks"
+	"github.com/merzzzl/warp/internal/protocol/socks4"
+	"github.com/merzzzl/warp/internal/protocol/socks5"
+	"github.com/merzzzl/warp/internal/protocol/ssh"
+	"github.com/merzzzl/warp/internal/protocol/wg"
+)
+
+func TestValidateViaUDP(t *testing.T) {
+	base := []ConfigProtocol{
+		{Name: "jump", SSH: &ssh.Config{}},
+		{Name: "old", SOCKS4: &socks4.Config{}},
+		{Name: "web", HTTP: &httpproxy.Config{}},
+		{Name: "vpn", WireGuard: &wg.Config{}},
+		{Name: "proxy", SOCKS5: &socks5.Config{}},
+		{Name: "proxy-jump", Via: "jump", SOCKS5: &socks5.Config{}},
+		{Name: "udp", Group: &group.Config{Members: []string{"vpn", "proxy"}}},
+		{Name: "mixed", Group: &group.Config{Members: []string{"proxy", "jump"}}},
+		{Name: "chain", Via: "mixed", SOCKS5: &socks5.Config{}},
+	}
+
+	tests := []struct {
+		p       ConfigProtocol
+		blocker string
+	}{
+		{ConfigProtocol{Via: "jump", WireGuard: &wg.Config{}}, "jump"},
+		{ConfigProtocol{Via: "old", Shadowsocks: &shadowsocks.Config{}}, "old"},
+		{ConfigProtocol{Via: "web", WireGuard: &wg.Config{}}, "web"},
+		{ConfigProtocol{Via: "proxy-jump", WireGuard: &wg.Config{}}, "jump"},
+		{ConfigProtocol{Via: "mixed", Shadowsocks: &shadowsocks.Config{}}, "jump"},
+		{ConfigProtocol{Via: "chain", WireGuard: &wg.Config{}}, "jump"},
+		{ConfigProtocol{Via: "vpn", WireGuard: &wg.Config{}}, ""},
+		{ConfigProtocol{Via: "proxy", Shadowsocks: &shadowsocks.Config{}}, ""},
+		{ConfigProtocol{Via: "udp", WireGuard: &wg.Config{}}, ""},
+		{ConfigProtocol{Via: "jump", SOCKS5: &socks5.Config{}}, ""},
+		{ConfigProtocol{Via: "mixed", HTTP: &httpproxy.Config{}}, ""},
+	}
+
+	for _, tt := range tests {
+		tt.p.Name = "new"
+		cfg := &Config{Protocols: append(append([]ConfigProtocol(nil), base...), tt.p)}
+
+		err := cfg.validate()
+
+		if tt.blocker == "" {
+			if err != nil {
+				t.Errorf("via %s: %v", tt.p.Via, err)
+			}
+
+			continue
+		}
+
+		if !errors.Is(err, errViaUDP) {
+			t.Errorf("via %s: got %v, want %v", tt.p.Via, err, errViaUDP)
+
+			continue
+		}
+
+		if got := cfg.noUDP(tt.p.Via); got != tt.blocker {
+			t.Errorf("via %s: blocked by %s, want %s", tt.p.Via, got, tt.blocker)
+		}
+	}
+}
@@ -3,21 +3,51 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/merzzzl/warp/internal/protocol/group"
+	"github.com/merzzzl/warp/internal/protocol/httpproxy"
+	"github.com/merzzzl/warp/internal/protocol/shadowsocks"
+	"github.com/merzzzl/warp/internal/protocol/socks4"
 	"github.com/merzzzl/warp/internal/protocol/socks5"
 	"github.com/merzzzl/warp/internal/protocol/ssh"
 	"github.com/merzzzl/warp/internal/protocol/wg"
 	"github.com/merzzzl/warp/internal/service"
 	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/sys"
 	"github.com/merzzzl/warp/internal/utils/tui"
 )
 
+// tunnel is a protocol that other protocols can be dialed through with via.
+type tunnel interface {
+	service.Protocol
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	platform, err := sys.New()
+	if err != nil {
+		log.Fatal().Err(err).Msg("APP", "failed to init platform")
+	}
+
+	journal := sys.NewJournal(platform, sys.JournalPath)
+
+	// Undo a crashed run first, a broken config must not leave its routes and DNS behind.
+	if journal.Pending() {
+		log.Warn().Str("journal", sys.JournalPath).Msg("APP", "rollback changes of previous run")
+
+		// Changes that could not be undone stay in the journal for the next run.
+		if err := journal.Rollback(); err != nil {
+			log.Warn().Err(err).Msg("APP", "partial rollback of previous run")
+		}
+	}
+
 	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatal().Err(err).Msg("APP", "failed on load config")
@@ -27,35 +57,22 @@ func main() {
 		log.EnableDebug()
 	}
 
-	srv, err := service.New(cfg.Tunnel)
+	if cfg.cleanup {
+		return
+	}
+
+	srv, err := service.New(cfg.Tunnel, journal)
 	if err != nil {
 		log.Fatal().Err(err).Msg("APP", "failed create tunnel")
 	}
 
-	if !cfg.verbose {
-		go func() {
-			defer cancel()
-
-			if err := tui.CreateTUI(srv.GetRoutes(), srv.GetTraffic(), cfg.fun); err != nil {
-				log.Error().Err(err).Msg("APP", "failed on create tui")
-			}
-		}()
-	} else {
-		go func() {
-			defer cancel()
-
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-			<-c
+	routes := make([]tunnel, len(cfg.Protocols))
 
-			if _, err := fmt.Print("\n"); err != nil {
-				return
-			}
-		}()
+	order, err := cfg.order()
+	if err != nil {
+		log.Fatal().Err(err).Msg("APP", "failed on load config")
 	}
 
-	group := []service.Protocol{}
-
 	// INFO: Add more protocols here
 	// protocol must implement:
 	//
@@ -67,45 +84,156 @@ func main() {
 	//  optional: FixedIPs() []string
 	//  optional: HandleTCP(conn net.Conn)
 	//  optional: HandleUDP(conn net.Conn)
+	//
+	//  Chaining with via:
+	//  required: DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Protocols dialed through another one are created after it.
+	for _, i := range order {
+		pConfig := cfg.Protocols[i]
+
+		var dial network.DialFunc
+		if pConfig.Via != "" {
+			dial = routes[cfg.index(pConfig.Via)].DialContext
+		}
 
-	for _, pConfig := range cfg.Protocols {
 		// Register SSH
 		if pConfig.SSH != nil {
-			sshR, err := ssh.New(pConfig.SSH)
+			sshR, err := ssh.New(ctx, pConfig.SSH, dial)
 			if err != nil {
 				log.Fatal().Err(err).Msg("APP", "failed to create SSH route")
 			}
 
-			group = append(group, sshR)
+			routes[i] = sshR
 
 			continue
 		}
 
 		// Register WireGuard
 		if pConfig.WireGuard != nil {
-			cbR, err := wg.New(ctx, pConfig.WireGuard)
+			cbR, err := wg.New(ctx, pConfig.WireGuard, dial)
 			if err != nil {
 				log.Fatal().Err(err).Msg("APP", "failed to create WireGuard route")
 			}
 
-			group = append(group, cbR)
+			routes[i] = cbR
 
 			continue
 		}
 
 		// Register SOCKS5
 		if pConfig.SOCKS5 != nil {
-			socks5R, err := socks5.New(pConfig.SOCKS5)
+			socks5R, err := socks5.New(pConfig.SOCKS5, dial)
 			if err != nil {
 				log.Fatal().Err(err).Msg("APP", "failed to create SOCKS5 route")
 			}
-			group = append(group, socks5R)
+
+			routes[i] = socks5R
+
+			continue
+		}
+
+		// Register SOCKS4
+		if pConfig.SOCKS4 != nil {
+			socks4R, err := socks4.New(pConfig.SOCKS4, dial)
+			if err != nil {
+				log.Fatal().Err(err).Msg("APP", "failed to create SOCKS4 route")
+			}
+
+			routes[i] = socks4R
+
+			continue
+		}
+
+		// Register HTTP CONNECT
+		if pConfig.HTTP != nil {
+			httpR, err := httpproxy.New(pConfig.HTTP, dial)
+			if err != nil {
+				log.Fatal().Err(err).Msg("APP", "failed to create HTTP route")
+			}
+
+			routes[i] = httpR
+
+			continue
+		}
+
+		// Register group
+		if pConfig.Group != nil {
+			members := make([]group.Member, 0, len(pConfig.Group.Members))
+
+			for _, name := range pConfig.Group.Members {
+				members = append(members, routes[cfg.index(name)])
+			}
+
+			groupR, err := group.New(ctx, pConfig.Group, members)
+			if err != nil {
+				log.Fatal().Err(err).Msg("APP", "failed to create group route")
+			}
+
+			routes[i] = groupR
+
+			continue
+		}
+
+		// Register Shadowsocks
+		if pConfig.Shadowsocks != nil {
+			ssR, err := shadowsocks.New(pConfig.Shadowsocks, dial)
+			if err != nil {
+				log.Fatal().Err(err).Msg("APP", "failed to create Shadowsocks route")
+			}
+
+			routes[i] = ssR
 
 			continue
 		}
 	}
 
-	if err := srv.ListenAndServe(ctx, group, cfg.ipv6); err != nil {
+	protocols := make([]service.Protocol, 0, len(routes))
+	named := make(map[string]service.Protocol)
+
+	for i, r := range routes {
+		protocols = append(protocols, r)
+
+		if name := cfg.Protocols[i].Name; name != "" {
+			named[name] = r
+		}
+	}
+
+	rules, err := service.NewRules(cfg.Rules, named)
+	if err != nil {
+		log.Fatal().Err(err).Msg("APP", "failed to create rules")
+	}
+
+	// The TUI takes the terminal, so protocols that prompt for secrets are created first.
+	if !cfg.verbose {
+		go func() {
+			defer cancel()
+
+			if err := tui.CreateTUI(srv.GetRoutes(), srv.GetTraffic(), srv.GetDNSCache(), cfg.fun); err != nil {
+				log.Error().Err(err).Msg("APP", "failed on create tui")
+			}
+		}()
+	} else {
+		go func() {
+			defer cancel()
+
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+			<-c
+
+			if _, err := fmt.Print("\n"); err != nil {
+				return
+			}
+		}()
+	}
+
+	err = srv.ListenAndServe(ctx, protocols, rules, cfg.IPv6)
+
+	if err := journal.Rollback(); err != nil {
+		log.Error().Err(err).Msg("APP", "failed to rollback system changes")
+	}
+
+	if err != nil {
 		log.Fatal().Err(err).Msg("APP", "failed to run service")
 	}
 }
@@ -7,13 +7,18 @@ require (
 	github.com/jroimartin/gocui v0.5.0
 	github.com/miekg/dns v1.1.56
 	github.com/rs/zerolog v1.30.0
+	github.com/sagernet/sing v0.3.0
+	github.com/sagernet/sing-shadowsocks2 v0.2.1
 	github.com/seancfoley/ipaddress-go v1.7.0
 	github.com/xjasonlyu/tun2socks/v2 v2.5.1
-	golang.org/x/crypto v0.13.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
 	gopkg.in/yaml.v2 v2.4.0
+	lukechampine.com/blake3 v1.2.1
 )
 
 require (
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/seancfoley/bintree v1.3.1 // indirect
 	gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259 // indirect
 )
@@ -26,7 +31,7 @@ require (
 	github.com/nsf/termbox-go v1.1.1 // indirect
 	golang.org/x/mod v0.12.0 // indirect
 	golang.org/x/net v0.15.0
-	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/sys v0.15.0
 	golang.org/x/time v0.3.0 // indirect
 	golang.org/x/tools v0.13.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
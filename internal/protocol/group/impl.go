@@ -0,0 +1,308 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+const (
+	StrategyFailover     = "failover"
+	StrategyRoundRobin   = "round-robin"
+	StrategyLeastLatency = "least-latency"
+)
+
+type Config struct {
+	Members  []string      `yaml:"members"`
+	Strategy string        `yaml:"strategy"`
+	Check    string        `yaml:"check"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Domains  []string      `yaml:"domains"`
+	IPs      []string      `yaml:"ips"`
+	IPv6     *bool         `yaml:"ipv6"`
+}
+
+var (
+	defaultInterval = 30 * time.Second
+	defaultTimeout  = 5 * time.Second
+	errStrategy     = errors.New("unknown group strategy")
+	errNoMembers    = errors.New("group has no members")
+	errNoCheck      = errors.New("group needs a check address to tell which members are up")
+)
+
+// Member is a protocol of the group, flows are dialed through it.
+type Member interface {
+	LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type memberHandleUDP interface {
+	HandleUDP(conn net.Conn)
+}
+
+type member struct {
+	name     string
+	protocol Member
+	down     atomic.Bool
+	latency  atomic.Int64
+}
+
+type Protocol struct {
+	members  []*member
+	strategy string
+	check    string
+	interval time.Duration
+	timeout  time.Duration
+	next     atomic.Uint32
+	domains  []string
+	ips      []string
+	ipv6     bool
+}
+
+// New creates the group, members are the protocols named by cfg.Members in the
+// same order. Members are checked in the background until ctx is done.
+func New(ctx context.Context, cfg *Config, members []Member) (*Protocol, error) {
+	if len(members) == 0 || len(members) != len(cfg.Members) {
+		return nil, errNoMembers
+	}
+
+	if cfg.Check == "" {
+		return nil, errNoCheck
+	}
+
+	p := &Protocol{
+		strategy: cfg.Strategy,
+		check:    cfg.Check,
+		interval: defaultInterval,
+		timeout:  defaultTimeout,
+		domains:  cfg.Domains,
+		ips:      cfg.IPs,
+		ipv6:     cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	switch p.strategy {
+	case "":
+		p.strategy = StrategyFailover
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastLatency:
+	default:
+		return nil, fmt.Errorf("%w: %s", errStrategy, cfg.Strategy)
+	}
+
+	if cfg.Interval > 0 {
+		p.interval = cfg.Interval
+	}
+
+	if cfg.Timeout > 0 {
+		p.timeout = cfg.Timeout
+	}
+
+	for i, m := range members {
+		p.members = append(p.members, &member{name: cfg.Members[i], protocol: m})
+	}
+
+	go p.watch(ctx)
+
+	return p, nil
+}
+
+// candidates returns the members in the order to try them: healthy members by
+// the strategy, then the ones marked down as a last resort.
+func (p *Protocol) candidates() []*member {
+	up := make([]*member, 0, len(p.members))
+	down := make([]*member, 0, len(p.members))
+
+	for _, m := range p.members {
+		if m.down.Load() {
+			down = append(down, m)
+		} else {
+			up = append(up, m)
+		}
+	}
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if len(up) > 0 {
+			i := int(p.next.Add(1)-1) % len(up)
+			up = append(append(make([]*member, 0, len(p.members)), up[i:]...), up[:i]...)
+		}
+	case StrategyLeastLatency:
+		// Members without a measurement yet go last.
+		sort.SliceStable(up, func(i, j int) bool {
+			a, b := up[i].latency.Load(), up[j].latency.Load()
+
+			return a != 0 && (b == 0 || a < b)
+		})
+	}
+
+	return append(up, down...)
+}
+
+// DialContext opens a connection to addr through the first member that can
+// dial it. A failed dial may be the fault of the destination, so only checks
+// change the health of members.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	var err error
+
+	for _, m := range p.candidates() {
+		var conn net.Conn
+
+		conn, err = m.protocol.DialContext(ctx, n, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		log.Debug().Str("dest", addr).Str("type", n).Str("member", m.name).Err(err).Msg("GRP", "try next member")
+	}
+
+	return nil, err
+}
+
+// mark records whether the member works and logs when that changes.
+func (p *Protocol) mark(m *member, up bool, err error) {
+	if m.down.Swap(!up) == !up {
+		return
+	}
+
+	if up {
+		log.Info().Str("member", m.name).Msg("GRP", "member is up")
+	} else {
+		log.Warn().Str("member", m.name).Err(err).Msg("GRP", "member is down")
+	}
+}
+
+// measure keeps a moving average of the dial time of the member.
+func (m *member) measure(d time.Duration) {
+	old := m.latency.Load()
+	if old == 0 {
+		m.latency.Store(int64(d))
+
+		return
+	}
+
+	m.latency.Store((old*3 + int64(d)) / 4)
+}
+
+// watch checks every member each interval.
+func (p *Protocol) watch(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		for _, m := range p.members {
+			go p.probe(ctx, m)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe dials the check address through the member.
+func (p *Protocol) probe(ctx context.Context, m *member) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	conn, err := m.protocol.DialContext(ctx, "tcp", p.check)
+	if err != nil {
+		// The group is shutting down.
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		}
+
+		p.mark(m, false, err)
+
+		return
+	}
+
+	_ = conn.Close()
+
+	m.measure(time.Since(start))
+	p.mark(m, true, nil)
+
+	log.Debug().Str("member", m.name).Str("latency", time.Duration(m.latency.Load()).String()).Msg("GRP", "check member")
+}
+
+func (p *Protocol) Domains() []string {
+	return p.domains
+}
+
+func (p *Protocol) FixedIPs() []string {
+	return p.ips
+}
+
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
+
+// LookupHost asks the members in turn until one answers.
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+
+	for _, m := range p.candidates() {
+		var rsp *dns.Msg
+
+		rsp, err = m.protocol.LookupHost(ctx, req)
+		if err == nil {
+			log.Debug().DNS(req).Str("member", m.name).Msg("GRP", "handle dns req")
+
+			return rsp, nil
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		log.Debug().DNS(req).Str("member", m.name).Err(err).Msg("GRP", "try next member")
+	}
+
+	return nil, err
+}
+
+func (p *Protocol) HandleTCP(conn net.Conn) {
+	remoteConn, err := p.DialContext(context.Background(), conn.LocalAddr().Network(), conn.LocalAddr().String())
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("GRP", "handle conn")
+		}
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("GRP", "handle conn")
+
+	network.Transfer("GRP", conn, remoteConn)
+}
+
+// HandleUDP hands the flow to the first member that relays udp, the member
+// reports its own errors so there is no failover.
+func (p *Protocol) HandleUDP(conn net.Conn) {
+	for _, m := range p.candidates() {
+		if handler, ok := m.protocol.(memberHandleUDP); ok {
+			handler.HandleUDP(conn)
+
+			return
+		}
+	}
+
+	log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("GRP", "no member relays udp")
+}
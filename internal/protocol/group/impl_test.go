@@ -0,0 +1,178 @@
+package group
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const checkAddr = "192.0.2.1:443"
+
+var errDestination = errors.New("connect failed: connection refused")
+
+// fakeMember refuses every destination but its reachable ones and answers
+// checks while it is healthy.
+type fakeMember struct {
+	name      string
+	reachable []string
+	healthy   bool
+	calls     *[]string
+	mx        *sync.Mutex
+}
+
+func (m *fakeMember) LookupHost(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, errDestination
+}
+
+func (m *fakeMember) DialContext(_ context.Context, _, addr string) (net.Conn, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if addr == checkAddr {
+		if !m.healthy {
+			return nil, errors.New("handshake failed")
+		}
+
+		conn, peer := net.Pipe()
+		_ = peer.Close()
+
+		return conn, nil
+	}
+
+	*m.calls = append(*m.calls, m.name+" "+addr)
+
+	if !slices.Contains(m.reachable, addr) {
+		return nil, errDestination
+	}
+
+	conn, peer := net.Pipe()
+	_ = peer.Close()
+
+	return conn, nil
+}
+
+func (m *fakeMember) setHealthy(healthy bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.healthy = healthy
+}
+
+func newGroup(t *testing.T, members ...*fakeMember) (*Protocol, func() []string) {
+	t.Helper()
+
+	var (
+		calls []string
+		mx    sync.Mutex
+		names []string
+		list  []Member
+	)
+
+	for _, m := range members {
+		m.calls, m.mx = &calls, &mx
+		names = append(names, m.name)
+		list = append(list, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p, err := New(ctx, &Config{Members: names, Check: checkAddr, Interval: time.Hour}, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the first checks, a passed check records the latency.
+	for _, m := range p.members {
+		for m.latency.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return p, func() []string {
+		mx.Lock()
+		defer mx.Unlock()
+
+		taken := calls
+		calls = nil
+
+		return taken
+	}
+}
+
+func TestDialKeepsHealth(t *testing.T) {
+	a := &fakeMember{name: "a", reachable: []string{"10.0.0.1:22"}, healthy: true}
+	b := &fakeMember{name: "b", reachable: []string{"10.0.0.1:22", "10.0.0.2:22"}, healthy: true}
+
+	p, calls := newGroup(t, a, b)
+
+	for i := 0; i < 2; i++ {
+		conn, err := p.DialContext(context.Background(), "tcp", "10.0.0.2:22")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = conn.Close()
+	}
+
+	// A destination only b reaches does not mark a down.
+	want := []string{"a 10.0.0.2:22", "b 10.0.0.2:22", "a 10.0.0.2:22", "b 10.0.0.2:22"}
+	if got := calls(); !slices.Equal(got, want) {
+		t.Fatalf("dials: got %q, want %q", got, want)
+	}
+
+	if _, err := p.DialContext(context.Background(), "tcp", "10.0.0.3:22"); !errors.Is(err, errDestination) {
+		t.Fatalf("unreachable destination: got %v, want %v", err, errDestination)
+	}
+
+	for _, m := range p.members {
+		if m.down.Load() {
+			t.Fatalf("member %s is down after destination errors", m.name)
+		}
+	}
+}
+
+func TestCheckMarksDown(t *testing.T) {
+	a := &fakeMember{name: "a", reachable: []string{"10.0.0.1:22"}, healthy: true}
+	b := &fakeMember{name: "b", reachable: []string{"10.0.0.1:22"}, healthy: true}
+
+	p, calls := newGroup(t, a, b)
+
+	a.setHealthy(false)
+	p.probe(context.Background(), p.members[0])
+
+	if !p.members[0].down.Load() {
+		t.Fatal("member a is up after a failed check")
+	}
+
+	conn, err := p.DialContext(context.Background(), "tcp", "10.0.0.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.Close()
+
+	if got, want := calls(), []string{"b 10.0.0.1:22"}; !slices.Equal(got, want) {
+		t.Fatalf("dials: got %q, want %q", got, want)
+	}
+
+	a.setHealthy(true)
+	p.probe(context.Background(), p.members[0])
+
+	if p.members[0].down.Load() {
+		t.Fatal("member a is down after a passed check")
+	}
+}
+
+func TestNewNeedsCheck(t *testing.T) {
+	_, err := New(context.Background(), &Config{Members: []string{"a"}}, []Member{&fakeMember{name: "a"}})
+	if !errors.Is(err, errNoCheck) {
+		t.Fatalf("group without check: got %v, want %v", err, errNoCheck)
+	}
+}
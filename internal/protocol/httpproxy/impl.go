@@ -0,0 +1,215 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/tlsconf"
+	"github.com/merzzzl/warp/internal/utils/upstream"
+)
+
+type Config struct {
+	User     string            `yaml:"user"`
+	Password string            `yaml:"password"`
+	Host     string            `yaml:"host"`
+	Headers  map[string]string `yaml:"headers"`
+	TLS      *tlsconf.Config   `yaml:"tls"`
+	Domains  []string          `yaml:"domains"`
+	IPs      []string          `yaml:"ips"`
+	DNS      []string          `yaml:"dns"`
+	IPv6     *bool             `yaml:"ipv6"`
+}
+
+var (
+	dialTimeout = 5 * time.Second
+	errStatus   = errors.New("http proxy refused connect")
+	errNetwork  = errors.New("http proxy only carries tcp")
+)
+
+type Protocol struct {
+	dial    network.DialFunc
+	host    string
+	header  http.Header
+	tls     *tls.Config
+	domains []string
+	dns     []*upstream.Upstream
+	ips     []string
+	ipv6    bool
+}
+
+// New creates the protocol, dial reaches the proxy and is the host network if nil.
+func New(cfg *Config, dial network.DialFunc) (*Protocol, error) {
+	var err error
+
+	if dial == nil {
+		dial = network.Direct
+	}
+
+	p := &Protocol{
+		dial:    dial,
+		host:    cfg.Host,
+		header:  make(http.Header),
+		domains: cfg.Domains,
+		ips:     cfg.IPs,
+		ipv6:    cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	for k, v := range cfg.Headers {
+		p.header.Set(k, v)
+	}
+
+	if cfg.User != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(cfg.User + ":" + cfg.Password))
+		p.header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if cfg.TLS != nil {
+		p.tls, err = tlsconf.New(cfg.TLS, cfg.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.dns, err = upstream.NewList(cfg.DNS, "tcp", p.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("url", cfg.Host).Msg("HTP", "open connection")
+
+	return p, nil
+}
+
+// DialContext opens a tunnel to addr with a CONNECT request.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(n, "tcp") {
+		return nil, fmt.Errorf("%w: %s", errNetwork, n)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: p.header,
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	rsp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	_ = rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("%w: %s %s", errStatus, addr, rsp.Status)
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	if reader.Buffered() != 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+func (p *Protocol) dialProxy(ctx context.Context) (net.Conn, error) {
+	conn, err := p.dial(ctx, "tcp", p.host)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tls == nil {
+		return conn, nil
+	}
+
+	return tlsconf.Client(ctx, conn, p.tls)
+}
+
+// bufferedConn returns the bytes the server sent right after its response first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (p *Protocol) Domains() []string {
+	return p.domains
+}
+
+func (p *Protocol) FixedIPs() []string {
+	return p.ips
+}
+
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
+
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().DNS(req).Msg("HTP", "handle dns req")
+
+	return rsp, nil
+}
+
+func (p *Protocol) HandleTCP(conn net.Conn) {
+	log.Debug().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("HTP", "open dial")
+
+	remoteConn, err := p.DialContext(context.Background(), conn.LocalAddr().Network(), conn.LocalAddr().String())
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("HTP", "handle conn")
+		}
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("HTP", "handle conn")
+
+	network.Transfer("HTP", conn, remoteConn)
+}
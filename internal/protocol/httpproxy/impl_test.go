@@ -0,0 +1,147 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startProxy serves CONNECT on 127.0.0.1 and sends every request it reads to
+// requests. Connections to deny.example are refused, the other ones get a
+// greeting in the same write as the response and are echoed after it.
+func startProxy(t *testing.T) (string, <-chan *http.Request) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	requests := make(chan *http.Request, 16)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+
+				requests <- req
+
+				if req.Host == "deny.example:443" {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+
+					return
+				}
+
+				if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello"); err != nil {
+					return
+				}
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), requests
+}
+
+func TestDialContext(t *testing.T) {
+	addr, requests := startProxy(t)
+
+	p, err := New(&Config{
+		Host:     addr,
+		User:     "alice",
+		Password: "secret",
+		Headers:  map[string]string{"x-corp-token": "abc"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := p.DialContext(ctx, "tcp", "db.example.com:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	req := <-requests
+
+	if req.Method != http.MethodConnect || req.Host != "db.example.com:5432" || req.RequestURI != "db.example.com:5432" {
+		t.Fatalf("request: %s %s host %s", req.Method, req.RequestURI, req.Host)
+	}
+
+	if user, password, ok := proxyAuth(req); !ok || user != "alice" || password != "secret" {
+		t.Fatalf("proxy authorization: %q", req.Header.Get("Proxy-Authorization"))
+	}
+
+	if got := req.Header.Get("X-Corp-Token"); got != "abc" {
+		t.Fatalf("custom header: %q", got)
+	}
+
+	// The greeting came with the response and is read before the echo.
+	if _, ok := conn.(*bufferedConn); !ok {
+		t.Fatalf("conn with buffered bytes is %T", conn)
+	}
+
+	if _, err := io.WriteString(conn, " world"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len("hello world"))
+
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
+
+func TestDialContextErrors(t *testing.T) {
+	addr, requests := startProxy(t)
+
+	p, err := New(&Config{Host: addr}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := p.DialContext(ctx, "tcp", "deny.example:443"); !errors.Is(err, errStatus) {
+		t.Fatalf("refused connect: got %v", err)
+	}
+
+	if req := <-requests; req.Header.Get("Proxy-Authorization") != "" {
+		t.Fatalf("proxy authorization without user: %q", req.Header.Get("Proxy-Authorization"))
+	}
+
+	if _, err := p.DialContext(ctx, "udp", "192.0.2.1:53"); !errors.Is(err, errNetwork) {
+		t.Fatalf("udp: got %v", err)
+	}
+}
+
+func proxyAuth(req *http.Request) (string, string, bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+
+	return r.BasicAuth()
+}
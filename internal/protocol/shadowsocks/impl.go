@@ -0,0 +1,160 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing-shadowsocks2/cipher"
+	_ "github.com/sagernet/sing-shadowsocks2/shadowaead"      // AEAD methods
+	_ "github.com/sagernet/sing-shadowsocks2/shadowaead_2022" // 2022-blake3 methods
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/upstream"
+)
+
+type Config struct {
+	Server     string        `yaml:"server"`
+	Method     string        `yaml:"method"`
+	Password   string        `yaml:"password"`
+	UDPTimeout time.Duration `yaml:"udp_timeout"`
+	Domains    []string      `yaml:"domains"`
+	IPs        []string      `yaml:"ips"`
+	DNS        []string      `yaml:"dns"`
+	IPv6       *bool         `yaml:"ipv6"`
+}
+
+var (
+	dialTimeout       = 5 * time.Second
+	defaultUDPTimeout = time.Minute
+)
+
+type Protocol struct {
+	dial       network.DialFunc
+	server     string
+	method     cipher.Method
+	udpTimeout time.Duration
+	domains    []string
+	dns        []*upstream.Upstream
+	ips        []string
+	ipv6       bool
+}
+
+// New creates the protocol, dial reaches the server and is the host network if nil.
+func New(cfg *Config, dial network.DialFunc) (*Protocol, error) {
+	method, err := cipher.CreateMethod(context.Background(), cfg.Method, cipher.MethodOptions{Password: cfg.Password})
+	if err != nil {
+		return nil, err
+	}
+
+	if dial == nil {
+		dial = network.Direct
+	}
+
+	p := &Protocol{
+		dial:       dial,
+		server:     cfg.Server,
+		method:     method,
+		udpTimeout: defaultUDPTimeout,
+		domains:    cfg.Domains,
+		ips:        cfg.IPs,
+		ipv6:       cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	if cfg.UDPTimeout > 0 {
+		p.udpTimeout = cfg.UDPTimeout
+	}
+
+	p.dns, err = upstream.NewList(cfg.DNS, "tcp", p.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("url", cfg.Server).Str("method", cfg.Method).Msg("SHS", "open connection")
+
+	return p, nil
+}
+
+// DialContext opens a stream to addr, the request header goes out with the
+// handshake. Datagrams to addr are relayed over udp.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	if strings.HasPrefix(n, "udp") {
+		return p.dialUDP(ctx, addr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, "tcp", p.server)
+	if err != nil {
+		return nil, err
+	}
+
+	ssConn, err := p.method.DialConn(conn, M.ParseSocksaddr(addr))
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	return ssConn, nil
+}
+
+func (p *Protocol) Domains() []string {
+	return p.domains
+}
+
+func (p *Protocol) FixedIPs() []string {
+	return p.ips
+}
+
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
+
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().DNS(req).Msg("SHS", "handle dns req")
+
+	return rsp, nil
+}
+
+func (p *Protocol) HandleTCP(conn net.Conn) {
+	log.Debug().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SHS", "open dial")
+
+	remoteConn, err := p.DialContext(context.Background(), conn.LocalAddr().Network(), conn.LocalAddr().String())
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SHS", "handle conn")
+		}
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SHS", "handle conn")
+
+	network.Transfer("SHS", conn, remoteConn)
+}
+
+func (p *Protocol) HandleUDP(conn net.Conn) {
+	remoteConn, err := p.dialUDP(context.Background(), conn.LocalAddr().String())
+	if err != nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SHS", "handle conn")
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SHS", "handle conn")
+
+	network.Transfer("SHS", conn, remoteConn)
+}
@@ -0,0 +1,528 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+// The test server speaks the server side of aes-128-gcm and
+// 2022-blake3-aes-128-gcm, which sing-shadowsocks2 does not ship. It echoes
+// every stream and datagram and reports the destinations the client asked for.
+const (
+	methodAEAD = "aes-128-gcm"
+	method2022 = "2022-blake3-aes-128-gcm"
+	keySize    = 16
+	tagSize    = 16
+)
+
+var errRejected = errors.New("rejected by the test server")
+
+type testServer struct {
+	addr    string
+	method  string
+	key     []byte
+	targets chan string
+	rejects chan error
+}
+
+func startServer(t *testing.T, method, password string) *testServer {
+	t.Helper()
+
+	s := &testServer{
+		method:  method,
+		targets: make(chan string, 16),
+		rejects: make(chan error, 16),
+	}
+
+	if method == method2022 {
+		key, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.key = key
+	} else {
+		s.key = legacyKey([]byte(password))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+
+		t.Skipf("udp port of %s is taken: %v", ln.Addr(), err)
+	}
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+		_ = pc.Close()
+	})
+
+	s.addr = ln.Addr().String()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if err := s.serveStream(conn); err != nil && !errors.Is(err, io.EOF) {
+					s.rejects <- err
+				}
+			}()
+		}
+	}()
+
+	go s.servePackets(pc)
+
+	return s
+}
+
+func newProtocol(t *testing.T, s *testServer, method, password string) *Protocol {
+	t.Helper()
+
+	p, err := New(&Config{Server: s.addr, Method: method, Password: password, UDPTimeout: 500 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// stream seals or opens consecutive chunks with an incrementing nonce.
+type stream struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newStream(s *testServer, salt []byte) (*stream, error) {
+	key := make([]byte, keySize)
+
+	if s.method == method2022 {
+		key = sessionKey(s.key, salt)
+	} else if _, err := io.ReadFull(hkdf.New(sha1.New, s.key, salt, []byte("ss-subkey")), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stream{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (s *stream) seal(p []byte) []byte {
+	out := s.aead.Seal(nil, s.nonce, p, nil)
+	increment(s.nonce)
+
+	return out
+}
+
+func (s *stream) open(r io.Reader, n int) ([]byte, error) {
+	sealed := make([]byte, n+tagSize)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+
+	p, err := s.aead.Open(nil, s.nonce, sealed, nil)
+	if err != nil {
+		return nil, errRejected
+	}
+
+	increment(s.nonce)
+
+	return p, nil
+}
+
+func (s *stream) readChunk(r io.Reader) ([]byte, error) {
+	length, err := s.open(r, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.open(r, int(binary.BigEndian.Uint16(length)))
+}
+
+func (s *stream) chunk(p []byte) []byte {
+	return append(s.seal(binary.BigEndian.AppendUint16(nil, uint16(len(p)))), s.seal(p)...)
+}
+
+// serveStream reads the request of one connection and echoes its payload.
+func (s *testServer) serveStream(conn net.Conn) error {
+	salt := make([]byte, keySize)
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return err
+	}
+
+	in, err := newStream(s, salt)
+	if err != nil {
+		return err
+	}
+
+	var (
+		target  M.Socksaddr
+		payload []byte
+	)
+
+	if s.method == method2022 {
+		fixed, err := in.open(conn, 1+8+2)
+		if err != nil {
+			return err
+		}
+
+		header, err := in.open(conn, int(binary.BigEndian.Uint16(fixed[9:])))
+		if err != nil {
+			return err
+		}
+
+		r := bytes.NewReader(header)
+
+		if target, err = M.SocksaddrSerializer.ReadAddrPort(r); err != nil {
+			return err
+		}
+
+		var padding uint16
+		if err := binary.Read(r, binary.BigEndian, &padding); err != nil {
+			return err
+		}
+
+		payload = header[len(header)-r.Len()+int(padding):]
+	} else {
+		first, err := in.readChunk(conn)
+		if err != nil {
+			return err
+		}
+
+		r := bytes.NewReader(first)
+
+		if target, err = M.SocksaddrSerializer.ReadAddrPort(r); err != nil {
+			return err
+		}
+
+		payload = first[len(first)-r.Len():]
+	}
+
+	s.targets <- "tcp " + target.String()
+
+	respSalt := make([]byte, keySize)
+	_, _ = rand.Read(respSalt)
+
+	out, err := newStream(s, respSalt)
+	if err != nil {
+		return err
+	}
+
+	response := respSalt
+
+	if s.method == method2022 {
+		fixed := append([]byte{1}, binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))...)
+		fixed = append(append(fixed, salt...), 0, 0)
+		response = append(append(response, out.seal(fixed)...), out.seal(nil)...)
+	}
+
+	if len(payload) > 0 {
+		response = append(response, out.chunk(payload)...)
+	}
+
+	if _, err := conn.Write(response); err != nil {
+		return err
+	}
+
+	for {
+		p, err := in.readChunk(conn)
+		if err != nil {
+			return err
+		}
+
+		if _, err := conn.Write(out.chunk(p)); err != nil {
+			return err
+		}
+	}
+}
+
+// servePackets echoes every datagram to the destination it was sent to.
+func (s *testServer) servePackets(pc net.PacketConn) {
+	packet := make([]byte, maxDatagram)
+	serverSession := make([]byte, 8)
+	_, _ = rand.Read(serverSession)
+
+	var packetID uint64
+
+	for {
+		n, from, err := pc.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+
+		var reply []byte
+
+		if s.method == method2022 {
+			packetID++
+			reply, err = s.echo2022(packet[:n], serverSession, packetID)
+		} else {
+			reply, err = s.echoAEAD(packet[:n])
+		}
+
+		if err != nil {
+			s.rejects <- err
+
+			continue
+		}
+
+		_, _ = pc.WriteTo(reply, from)
+	}
+}
+
+func (s *testServer) echoAEAD(packet []byte) ([]byte, error) {
+	if len(packet) < keySize+tagSize {
+		return nil, errRejected
+	}
+
+	in, err := newStream(s, packet[:keySize])
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := in.open(bytes.NewReader(packet[keySize:]), len(packet)-keySize-tagSize)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(body)
+
+	target, err := M.SocksaddrSerializer.ReadAddrPort(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.targets <- "udp " + target.String()
+
+	salt := make([]byte, keySize)
+	_, _ = rand.Read(salt)
+
+	out, err := newStream(s, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(salt, out.seal(body)...), nil
+}
+
+func (s *testServer) echo2022(packet, serverSession []byte, packetID uint64) ([]byte, error) {
+	if len(packet) < aes.BlockSize+tagSize {
+		return nil, errRejected
+	}
+
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, aes.BlockSize)
+	block.Decrypt(header, packet[:aes.BlockSize])
+
+	in, err := newGCM(sessionKey(s.key, header[:8]))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := in.Open(nil, header[4:16], packet[aes.BlockSize:], nil)
+	if err != nil {
+		return nil, errRejected
+	}
+
+	// type, timestamp, padding length, padding, address and payload
+	padding := int(binary.BigEndian.Uint16(body[9:11]))
+	r := bytes.NewReader(body[11+padding:])
+
+	target, err := M.SocksaddrSerializer.ReadAddrPort(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.targets <- "udp " + target.String()
+
+	addrPort := body[11+padding : len(body)-r.Len()]
+	payload := body[len(body)-r.Len():]
+
+	reply := append([]byte{1}, binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))...)
+	reply = append(append(append(reply, header[:8]...), 0, 0), addrPort...)
+	reply = append(reply, payload...)
+
+	replyHeader := append(append([]byte{}, serverSession...), binary.BigEndian.AppendUint64(nil, packetID)...)
+
+	out, err := newGCM(sessionKey(s.key, serverSession))
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := out.Seal(nil, replyHeader[4:16], reply, nil)
+	block.Encrypt(replyHeader, replyHeader)
+
+	return append(replyHeader, sealed...), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sessionKey(psk, salt []byte) []byte {
+	key := make([]byte, keySize)
+	blake3.DeriveKey(key, "shadowsocks 2022 session subkey", append(append([]byte{}, psk...), salt...))
+
+	return key
+}
+
+// legacyKey is EVP_BytesToKey with MD5 as the AEAD methods use it.
+func legacyKey(password []byte) []byte {
+	var key, prev []byte
+
+	for len(key) < keySize {
+		sum := md5.Sum(append(prev, password...))
+		prev = sum[:]
+		key = append(key, prev...)
+	}
+
+	return key[:keySize]
+}
+
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func newKey(t *testing.T) string {
+	t.Helper()
+
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func roundTrip(conn net.Conn, payload string) (string, error) {
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		return "", err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	got := make([]byte, buf.BufferSize)
+
+	n, err := conn.Read(got)
+
+	return string(got[:n]), err
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, method := range []string{methodAEAD, method2022} {
+		t.Run(method, func(t *testing.T) {
+			password := "secret"
+			if strings.HasPrefix(method, "2022") {
+				password = newKey(t)
+			}
+
+			s := startServer(t, method, password)
+			p := newProtocol(t, s, method, password)
+
+			for _, tt := range []struct{ n, addr string }{
+				{"tcp", "192.0.2.1:80"},
+				{"tcp", "[2001:db8::1]:443"},
+				{"udp", "192.0.2.1:5353"},
+				{"udp", "[2001:db8::1]:5353"},
+			} {
+				conn, err := p.DialContext(context.Background(), tt.n, tt.addr)
+				if err != nil {
+					t.Fatalf("%s %s: %v", tt.n, tt.addr, err)
+				}
+
+				for i, payload := range []string{"ping", "pong"} {
+					got, err := roundTrip(conn, payload)
+					if err != nil || got != payload {
+						t.Fatalf("%s %s: got %q %v, want %q", tt.n, tt.addr, got, err, payload)
+					}
+
+					// A stream sends the destination with the request only.
+					if i != 0 && tt.n == "tcp" {
+						continue
+					}
+
+					if target := <-s.targets; target != tt.n+" "+tt.addr {
+						t.Fatalf("server saw %s, want %s %s", target, tt.n, tt.addr)
+					}
+				}
+
+				_ = conn.Close()
+			}
+		})
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	for _, method := range []string{methodAEAD, method2022} {
+		t.Run(method, func(t *testing.T) {
+			password, wrong := "secret", "guess"
+			if strings.HasPrefix(method, "2022") {
+				password, wrong = newKey(t), newKey(t)
+			}
+
+			s := startServer(t, method, password)
+			p := newProtocol(t, s, method, wrong)
+
+			for _, n := range []string{"tcp", "udp"} {
+				conn, err := p.DialContext(context.Background(), n, "192.0.2.1:53")
+				if err != nil {
+					t.Fatalf("%s: %v", n, err)
+				}
+
+				if got, err := roundTrip(conn, "ping"); err == nil {
+					t.Fatalf("%s: wrong password got %q", n, got)
+				}
+
+				if err := <-s.rejects; !errors.Is(err, errRejected) {
+					t.Fatalf("%s: server failed with %v, want a rejected request", n, err)
+				}
+
+				_ = conn.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	N "github.com/sagernet/sing/common/network"
+)
+
+const maxDatagram = 65535
+
+// udpConn relays the datagrams of one flow to target through the server, the
+// flow ends after it is idle for the timeout.
+type udpConn struct {
+	N.NetPacketConn
+	server  net.Addr
+	target  net.Addr
+	timeout time.Duration
+	active  atomic.Int64
+	buf     []byte
+}
+
+func (p *Protocol) dialUDP(ctx context.Context, target string) (*udpConn, error) {
+	dst, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, "udp", p.server)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &udpConn{
+		NetPacketConn: p.method.DialPacketConn(conn),
+		server:        conn.RemoteAddr(),
+		target:        dst,
+		timeout:       p.udpTimeout,
+		buf:           make([]byte, maxDatagram),
+	}
+
+	c.active.Store(time.Now().UnixNano())
+
+	return c, nil
+}
+
+// Read returns the payload of the next datagram from the server.
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		_ = c.NetPacketConn.SetReadDeadline(time.Unix(0, c.active.Load()).Add(c.timeout))
+
+		n, _, err := c.NetPacketConn.ReadFrom(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, c.active.Load())) < c.timeout {
+				continue
+			}
+
+			return 0, err
+		}
+
+		c.active.Store(time.Now().UnixNano())
+
+		return copy(b, c.buf[:n]), nil
+	}
+}
+
+func (c *udpConn) Write(b []byte) (int, error) {
+	c.active.Store(time.Now().UnixNano())
+
+	return c.NetPacketConn.WriteTo(b, c.target)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.server
+}
@@ -0,0 +1,223 @@
+package socks4
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/tlsconf"
+	"github.com/merzzzl/warp/internal/utils/upstream"
+)
+
+type Config struct {
+	User    string          `yaml:"user"`
+	Host    string          `yaml:"host"`
+	TLS     *tlsconf.Config `yaml:"tls"`
+	Domains []string        `yaml:"domains"`
+	IPs     []string        `yaml:"ips"`
+	DNS     []string        `yaml:"dns"`
+	IPv6    *bool           `yaml:"ipv6"`
+}
+
+const (
+	version        = 0x04
+	cmdConnect     = 0x01
+	replyGranted   = 0x5a
+	maxHostnameLen = 255
+)
+
+var (
+	dialTimeout = 5 * time.Second
+	errIPv6     = errors.New("socks4 can not connect to ipv6 addresses")
+	errReply    = errors.New("socks4 request rejected")
+	errHostname = errors.New("socks4a hostname too long")
+	errNetwork  = errors.New("socks4 only carries tcp")
+)
+
+type Protocol struct {
+	dial    network.DialFunc
+	host    string
+	user    string
+	tls     *tls.Config
+	domains []string
+	dns     []*upstream.Upstream
+	ips     []string
+	ipv6    bool
+}
+
+// New creates the protocol, dial reaches the proxy and is the host network if nil.
+func New(cfg *Config, dial network.DialFunc) (*Protocol, error) {
+	var err error
+
+	if dial == nil {
+		dial = network.Direct
+	}
+
+	p := &Protocol{
+		dial:    dial,
+		host:    cfg.Host,
+		user:    cfg.User,
+		domains: cfg.Domains,
+		ips:     cfg.IPs,
+		ipv6:    cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	if cfg.TLS != nil {
+		p.tls, err = tlsconf.New(cfg.TLS, cfg.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.dns, err = upstream.NewList(cfg.DNS, "tcp", p.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("url", cfg.Host).Msg("SC4", "open connection")
+
+	return p, nil
+}
+
+// DialContext asks the proxy for a connection to addr, host names are sent
+// with the SOCKS4a extension for the proxy to resolve.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(n, "tcp") {
+		return nil, fmt.Errorf("%w: %s", errNetwork, n)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	req := []byte{version, cmdConnect}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+
+	ip, err := netip.ParseAddr(host)
+
+	switch {
+	case err != nil && len(host) > maxHostnameLen:
+		return nil, fmt.Errorf("%w: %s", errHostname, host)
+	case err != nil:
+		// 0.0.0.1 tells a SOCKS4a proxy that the name follows the user id.
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, p.user...)
+		req = append(req, 0)
+		req = append(req, host...)
+	case !ip.Unmap().Is4():
+		return nil, fmt.Errorf("%w: %s", errIPv6, addr)
+	default:
+		ip4 := ip.Unmap().As4()
+		req = append(req, ip4[:]...)
+		req = append(req, p.user...)
+	}
+
+	req = append(req, 0)
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	var reply [8]byte
+
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	if reply[1] != replyGranted {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("%w: %s code %#x", errReply, addr, reply[1])
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (p *Protocol) dialProxy(ctx context.Context) (net.Conn, error) {
+	conn, err := p.dial(ctx, "tcp", p.host)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tls == nil {
+		return conn, nil
+	}
+
+	return tlsconf.Client(ctx, conn, p.tls)
+}
+
+func (p *Protocol) Domains() []string {
+	return p.domains
+}
+
+func (p *Protocol) FixedIPs() []string {
+	return p.ips
+}
+
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
+
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().DNS(req).Msg("SC4", "handle dns req")
+
+	return rsp, nil
+}
+
+func (p *Protocol) HandleTCP(conn net.Conn) {
+	log.Debug().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SC4", "open dial")
+
+	remoteConn, err := p.DialContext(context.Background(), conn.LocalAddr().Network(), conn.LocalAddr().String())
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SC4", "handle conn")
+		}
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SC4", "handle conn")
+
+	network.Transfer("SC4", conn, remoteConn)
+}
@@ -0,0 +1,170 @@
+package socks4
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startProxy serves SOCKS4 and SOCKS4a on 127.0.0.1, it sends every request it
+// reads to requests, rejects the host reject.example and greets the client otherwise.
+func startProxy(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	requests := make(chan string, 16)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				req, err := readRequest(bufio.NewReader(conn))
+				if err != nil {
+					requests <- err.Error()
+
+					return
+				}
+
+				requests <- req
+
+				reply := []byte{0, replyGranted, 0, 0, 0, 0, 0, 0}
+				if strings.Contains(req, "reject.example") {
+					reply[1] = 0x5b
+				}
+
+				if _, err := conn.Write(reply); err != nil || reply[1] != replyGranted {
+					return
+				}
+
+				_, _ = conn.Write([]byte("hello"))
+			}()
+		}
+	}()
+
+	return l.Addr().String(), requests
+}
+
+func readRequest(r *bufio.Reader) (string, error) {
+	var head [8]byte
+
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", err
+	}
+
+	if head[0] != version || head[1] != cmdConnect {
+		return "", fmt.Errorf("bad request %x", head[:2])
+	}
+
+	user, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	port := binary.BigEndian.Uint16(head[2:4])
+	host := netip.AddrFrom4([4]byte(head[4:8])).String()
+
+	// 0.0.0.x is followed by the host name.
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		host, err = r.ReadString(0)
+		if err != nil {
+			return "", err
+		}
+
+		host = strings.TrimSuffix(host, "\x00")
+	}
+
+	return fmt.Sprintf("%s@%s:%d", strings.TrimSuffix(user, "\x00"), host, port), nil
+}
+
+func TestDialContext(t *testing.T) {
+	addr, requests := startProxy(t)
+
+	p, err := New(&Config{Host: addr, User: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		network string
+		addr    string
+		request string
+		err     error
+	}{
+		{"tcp", "192.0.2.1:8080", "alice@192.0.2.1:8080", nil},
+		{"tcp4", "[::ffff:192.0.2.1]:443", "alice@192.0.2.1:443", nil},
+		{"tcp", "db.example.com:5432", "alice@db.example.com:5432", nil},
+		{"tcp", "reject.example:80", "alice@reject.example:80", errReply},
+		{"tcp", "[2001:db8::1]:80", "", errIPv6},
+		{"tcp", strings.Repeat("a", maxHostnameLen+1) + ":80", "", errHostname},
+		{"udp", "192.0.2.1:53", "", errNetwork},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		conn, err := p.DialContext(ctx, tt.network, tt.addr)
+
+		cancel()
+
+		if tt.request == "" {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s %s: got %v, want %v", tt.network, tt.addr, err, tt.err)
+			}
+
+			continue
+		}
+
+		if req := <-requests; req != tt.request {
+			t.Errorf("%s %s: proxy got %q, want %q", tt.network, tt.addr, req, tt.request)
+		}
+
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s %s: got %v, want %v", tt.network, tt.addr, err, tt.err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.network, tt.addr, err)
+
+			continue
+		}
+
+		greeting, err := io.ReadAll(conn)
+		if err != nil || string(greeting) != "hello" {
+			t.Errorf("%s %s: read %q %v", tt.network, tt.addr, greeting, err)
+		}
+
+		conn.Close()
+	}
+
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected request %q", req)
+	default:
+	}
+}
@@ -2,41 +2,62 @@ package socks5
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
 	"golang.org/x/net/proxy"
 
+	"github.com/merzzzl/warp/internal/utils/fakeip"
 	"github.com/merzzzl/warp/internal/utils/log"
 	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/tlsconf"
+	"github.com/merzzzl/warp/internal/utils/upstream"
 )
 
 type Config struct {
-	User     string   `yaml:"user"`
-	Password string   `yaml:"password"`
-	Host     string   `yaml:"host"`
-	Domains  []string `yaml:"domains"`
-	IPs      []string `yaml:"ips"`
-	DNS      []string `yaml:"dns"`
+	User       string          `yaml:"user"`
+	Password   string          `yaml:"password"`
+	Host       string          `yaml:"host"`
+	UDPTimeout time.Duration   `yaml:"udp_timeout"`
+	FakeIP     string          `yaml:"fake_ip"`
+	TLS        *tlsconf.Config `yaml:"tls"`
+	Domains    []string        `yaml:"domains"`
+	IPs        []string        `yaml:"ips"`
+	DNS        []string        `yaml:"dns"`
+	IPv6       *bool           `yaml:"ipv6"`
 }
 
+var (
+	errFakeIP = errors.New("no name for fake ip, was it handed out before a restart")
+	errDialer = errors.New("socks5 dialer does not take a context")
+)
+
 type Protocol struct {
-	host    string
-	dialer  proxy.Dialer
-	auth    *proxy.Auth
-	domains []string
-	dns     []string
-	ips     []string
-	mx      sync.Mutex
+	host       string
+	forward    *forwardDialer
+	dialer     proxy.ContextDialer
+	auth       *proxy.Auth
+	udpTimeout time.Duration
+	fake       *fakeip.Pool
+	domains    []string
+	dns        []*upstream.Upstream
+	ips        []string
+	ipv6       bool
+	mx         sync.Mutex
 }
 
-func New(cfg *Config) (*Protocol, error) {
+// New creates the protocol, dial reaches the proxy and is the host network if nil.
+func New(cfg *Config, dial network.DialFunc) (*Protocol, error) {
 	var auth *proxy.Auth
 
 	if cfg.User != "" && cfg.Password != "" {
@@ -46,28 +67,91 @@ func New(cfg *Config) (*Protocol, error) {
 		}
 	}
 
-	dialer, err := proxy.SOCKS5("tcp", cfg.Host, auth, proxy.Direct)
+	forward, err := newForwardDialer(cfg, dial)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(cfg.Host, auth, forward)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debug().Str("url", fmt.Sprintf("%s", cfg.Host)).Msg("SOC", "open connection")
 
-	return &Protocol{
-		host:    cfg.Host,
-		auth:    auth,
-		dns:     cfg.DNS,
-		dialer:  dialer,
-		domains: cfg.Domains,
-		ips:     cfg.IPs,
-	}, nil
+	p := &Protocol{
+		host:       cfg.Host,
+		forward:    forward,
+		auth:       auth,
+		dialer:     dialer,
+		udpTimeout: defaultUDPTimeout,
+		domains:    cfg.Domains,
+		ips:        cfg.IPs,
+		ipv6:       cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	if cfg.UDPTimeout > 0 {
+		p.udpTimeout = cfg.UDPTimeout
+	}
+
+	// The proxy resolves the names, traffic to the whole range goes through it.
+	if cfg.FakeIP != "" {
+		p.fake, err = fakeip.New(cfg.FakeIP)
+		if err != nil {
+			return nil, err
+		}
+
+		p.ips = append(append([]string(nil), cfg.IPs...), p.fake.Prefix().String())
+	}
+
+	p.dns, err = upstream.NewList(cfg.DNS, "tcp", p.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
 }
 
-func (p *Protocol) dial(n, addr string) (net.Conn, error) {
+// DialContext opens a connection to addr through the proxy, udp goes over an
+// association and fake ips are dialed by their name.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return p.dialName(ctx, n, addr)
+	}
+
+	host, port, release, err := p.destination(net.TCPAddrFromAddrPort(addrPort))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.dialName(ctx, n, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil || p.fake == nil || !p.fake.Contains(addrPort.Addr()) {
+		release()
+
+		return conn, err
+	}
+
+	return &releaseConn{Conn: conn, release: release}, nil
+}
+
+func (p *Protocol) dialName(ctx context.Context, n, addr string) (net.Conn, error) {
+	if strings.HasPrefix(n, "udp") {
+		return p.associate(ctx, socks5.ParseAddrString(addr))
+	}
+
+	return p.dial(ctx, n, addr)
+}
+
+func (p *Protocol) dial(ctx context.Context, n, addr string) (net.Conn, error) {
 	for i := 0; ; i++ {
 		log.Debug().Str("attempt", strconv.Itoa(i)).Str("dest", addr).Str("type", n).Msg("SOC", "open dial")
 
-		conn, err := p.dialer.Dial(n, addr)
+		p.mx.Lock()
+		dialer := p.dialer
+		p.mx.Unlock()
+
+		conn, err := dialer.DialContext(ctx, n, addr)
 		if err == nil || i == 2 {
 			return conn, err
 		}
@@ -78,27 +162,52 @@ func (p *Protocol) dial(n, addr string) (net.Conn, error) {
 
 		log.Warn().Str("dest", addr).Str("type", n).Str("url", fmt.Sprintf("%s", p.host)).Err(err).Msg("SOC", "reopen connection")
 
-		if !p.mx.TryLock() {
-			time.Sleep(1 * time.Second)
+		if err := p.reopen(dialer); err != nil {
+			log.Error().Err(err).Msg("SOC", "failed to open socks5 tunnel")
 
-			continue
+			return nil, err
 		}
 
-		dialer, err := proxy.SOCKS5("tcp", p.host, p.auth, proxy.Direct)
-		if err != nil {
-			log.Error().Err(err).Msg("SOC", "failed to open socks5 tunnel")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
 
-			p.mx.Unlock()
+// reopen replaces the failed dialer, dials that failed with it at the same time
+// share the replacement.
+func (p *Protocol) reopen(failed proxy.ContextDialer) error {
+	p.mx.Lock()
+	defer p.mx.Unlock()
 
-			return nil, err
-		}
+	if p.dialer != failed {
+		return nil
+	}
+
+	dialer, err := newDialer(p.host, p.auth, p.forward)
+	if err != nil {
+		return err
+	}
 
-		p.dialer = dialer
+	p.dialer = dialer
 
-		p.mx.Unlock()
+	return nil
+}
 
-		time.Sleep(1 * time.Second)
+func newDialer(host string, auth *proxy.Auth, forward *forwardDialer) (proxy.ContextDialer, error) {
+	dialer, err := proxy.SOCKS5("tcp", host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errDialer
 	}
+
+	return contextDialer, nil
 }
 
 func (p *Protocol) Domains() []string {
@@ -109,46 +218,64 @@ func (p *Protocol) FixedIPs() []string {
 	return p.ips
 }
 
-func (p *Protocol) LookupHost(_ context.Context, req *dns.Msg) *dns.Msg {
-	for _, addr := range p.dns {
-		dnsConn, err := p.dial("tcp", addr+":53")
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SOC", "handle dns req")
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
 
-			continue
-		}
+// NoCache reports whether req gets a fake ip answer, those must come from the
+// pool every time so an address is not handed out again while it is cached.
+func (p *Protocol) NoCache(req *dns.Msg) bool {
+	return p.fake != nil && (req.Question[0].Qtype == dns.TypeA || len(p.dns) == 0)
+}
 
-		co := new(dns.Conn)
-		co.Conn = dnsConn
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if p.NoCache(req) {
+		log.Debug().DNS(req).Msg("SOC", "answer with fake ip")
 
-		err = co.WriteMsg(req)
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SOC", "write dns req")
+		return p.fake.Answer(req)
+	}
 
-			continue
-		}
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
+	}
 
-		rsp, err := co.ReadMsg()
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SOC", "read dns req")
+	log.Debug().DNS(req).Msg("SOC", "handle dns req")
 
-			continue
-		}
+	return rsp, nil
+}
 
-		log.Debug().Str("server", addr).DNS(req).Msg("SOC", "handle dns req")
+// destination returns the host and port to ask the proxy for, the name behind a
+// fake ip or the address itself. The fake ip stays taken until release is called.
+func (p *Protocol) destination(addr net.Addr) (string, uint16, func(), error) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return "", 0, nil, err
+	}
 
-		if len(rsp.Answer) == 0 {
-			continue
-		}
+	if p.fake == nil || !p.fake.Contains(addrPort.Addr()) {
+		return addrPort.Addr().Unmap().String(), addrPort.Port(), func() {}, nil
+	}
 
-		return rsp
+	name, release, ok := p.fake.Open(addrPort.Addr())
+	if !ok {
+		return "", 0, nil, fmt.Errorf("%w: %s", errFakeIP, addrPort.Addr())
 	}
 
-	return req
+	return name, addrPort.Port(), release, nil
 }
 
 func (p *Protocol) HandleTCP(conn net.Conn) {
-	remoteConn, err := p.dial(conn.LocalAddr().Network(), conn.LocalAddr().String())
+	host, port, release, err := p.destination(conn.LocalAddr())
+	if err != nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SOC", "handle conn")
+
+		return
+	}
+
+	defer release()
+
+	remoteConn, err := p.dial(context.Background(), conn.LocalAddr().Network(), net.JoinHostPort(host, strconv.Itoa(int(port))))
 	if err != nil {
 		if !errors.Is(err, io.EOF) {
 			log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SSH", "handle conn")
@@ -161,3 +288,75 @@ func (p *Protocol) HandleTCP(conn net.Conn) {
 
 	network.Transfer("SOC", conn, remoteConn)
 }
+
+func (p *Protocol) HandleUDP(conn net.Conn) {
+	host, port, release, err := p.destination(conn.LocalAddr())
+	if err != nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SOC", "handle conn")
+
+		return
+	}
+
+	defer release()
+
+	remoteConn, err := p.associate(context.Background(), socks5.ParseAddrString(net.JoinHostPort(host, strconv.Itoa(int(port)))))
+	if err != nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SOC", "handle conn")
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SOC", "handle conn")
+
+	network.Transfer("SOC", conn, remoteConn)
+}
+
+// releaseConn gives up the fake ip of a dialed connection when it is closed.
+type releaseConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.release()
+
+	return c.Conn.Close()
+}
+
+// forwardDialer connects to the proxy with dial, over TLS if the protocol has a tls block.
+type forwardDialer struct {
+	dial network.DialFunc
+	tls  *tls.Config
+}
+
+func newForwardDialer(cfg *Config, dial network.DialFunc) (*forwardDialer, error) {
+	if dial == nil {
+		dial = network.Direct
+	}
+
+	if cfg.TLS == nil {
+		return &forwardDialer{dial: dial}, nil
+	}
+
+	tlsConfig, err := tlsconf.New(cfg.TLS, cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &forwardDialer{dial: dial, tls: tlsConfig}, nil
+}
+
+func (d *forwardDialer) Dial(n, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), n, addr)
+}
+
+func (d *forwardDialer) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	if d.tls == nil {
+		return d.dial(ctx, n, addr)
+	}
+
+	return tlsconf.Dial(ctx, d.dial, addr, d.tls)
+}
@@ -0,0 +1,60 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialContextDeadline(t *testing.T) {
+	// The proxy accepts connections but never answers the greeting.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		var conns []net.Conn
+
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conns = append(conns, conn)
+		}
+	}()
+
+	p, err := New(&Config{Host: l.Addr().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []string{"tcp", "udp"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+
+		_, err := p.DialContext(ctx, n, "192.0.2.1:53")
+
+		cancel()
+
+		if err == nil {
+			t.Fatalf("%s: dial through a silent proxy succeeded", n)
+		}
+
+		// The dial timeout of the proxy connection is 5s.
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: dial returned after %s, want the deadline of the context", n, elapsed)
+		}
+	}
+}
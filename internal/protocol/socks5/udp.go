@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+const maxDatagram = 65535
+
+var (
+	defaultUDPTimeout = time.Minute
+	dialTimeout       = 5 * time.Second
+	errRelayAddr      = errors.New("socks5 relay address is not an ip")
+)
+
+// udpConn is a UDP association of one flow, datagrams written to it are sent to
+// target through the relay of the server. The association ends with its
+// control connection or after the flow is idle for the timeout.
+type udpConn struct {
+	net.Conn
+	ctrl    net.Conn
+	target  socks5.Addr
+	timeout time.Duration
+	active  atomic.Int64
+	buf     []byte
+}
+
+// associate asks the server for a relay with UDP ASSOCIATE, RFC 1928 section 7.
+func (p *Protocol) associate(ctx context.Context, target socks5.Addr) (*udpConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	ctrl, err := p.forward.DialContext(ctx, "tcp", p.host)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *socks5.User
+	if p.auth != nil {
+		user = &socks5.User{Username: p.auth.User, Password: p.auth.Password}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(deadline)
+	}
+
+	bound, err := socks5.ClientHandshake(ctrl, socks5.SerializeAddr("", net.IPv4zero, 0), socks5.CmdUDPAssociate, user)
+	if err != nil {
+		_ = ctrl.Close()
+
+		return nil, err
+	}
+
+	_ = ctrl.SetDeadline(time.Time{})
+
+	relay := bound.UDPAddr()
+	if relay == nil {
+		_ = ctrl.Close()
+
+		return nil, errRelayAddr
+	}
+
+	// Servers behind NAT or listening on every address reply with 0.0.0.0.
+	if tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok && relay.IP.IsUnspecified() {
+		relay.IP = tcpAddr.IP
+	}
+
+	conn, err := p.forward.dial(ctx, "udp", relay.String())
+	if err != nil {
+		_ = ctrl.Close()
+
+		return nil, err
+	}
+
+	c := &udpConn{
+		Conn:    conn,
+		ctrl:    ctrl,
+		target:  target,
+		timeout: p.udpTimeout,
+		buf:     make([]byte, maxDatagram),
+	}
+
+	c.active.Store(time.Now().UnixNano())
+
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+
+		_ = c.Close()
+	}()
+
+	return c, nil
+}
+
+// Read returns the payload of the next datagram from the target.
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		_ = c.Conn.SetReadDeadline(time.Unix(0, c.active.Load()).Add(c.timeout))
+
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, c.active.Load())) < c.timeout {
+				continue
+			}
+
+			return 0, err
+		}
+
+		_, payload, err := socks5.DecodeUDPPacket(c.buf[:n])
+		if err != nil {
+			continue
+		}
+
+		c.active.Store(time.Now().UnixNano())
+
+		return copy(b, payload), nil
+	}
+}
+
+// Write sends b to the target with the SOCKS5 UDP request header.
+func (c *udpConn) Write(b []byte) (int, error) {
+	packet, err := socks5.EncodeUDPPacket(c.target, b)
+	if err != nil {
+		return 0, err
+	}
+
+	c.active.Store(time.Now().UnixNano())
+
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *udpConn) Close() error {
+	_ = c.ctrl.Close()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,340 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a SOCKS5 server on loopback that only serves UDP ASSOCIATE.
+// Its relays answer every datagram with "echo:" and the payload, addressed
+// from the target of the request.
+type testServer struct {
+	ln      net.Listener
+	targets chan string
+	mx      sync.Mutex
+	ctrls   []net.Conn
+	open    int
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{ln: ln, targets: make(chan string, 16)}
+
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(t, conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) serve(t *testing.T, ctrl net.Conn) {
+	defer ctrl.Close()
+
+	// Greeting: VER NMETHODS METHODS, answered with no authentication.
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, head); err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(ctrl, make([]byte, head[1])); err != nil {
+		return
+	}
+
+	if _, err := ctrl.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: VER CMD RSV followed by the client address.
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, req); err != nil || req[1] != 3 {
+		t.Errorf("unexpected request %v: %v", req, err)
+
+		return
+	}
+
+	if _, err := readAddr(ctrl); err != nil {
+		return
+	}
+
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+
+		return
+	}
+
+	defer relay.Close()
+
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	reply := append([]byte{5, 0, 0, 1, 127, 0, 0, 1}, byte(port>>8), byte(port))
+
+	if _, err := ctrl.Write(reply); err != nil {
+		return
+	}
+
+	s.mx.Lock()
+	s.ctrls = append(s.ctrls, ctrl)
+	s.open++
+	s.mx.Unlock()
+
+	// The relay lives as long as the control connection.
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = relay.Close()
+	}()
+
+	buf := make([]byte, maxDatagram)
+
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		// Datagram: RSV RSV FRAG, the target address and the payload.
+		if n < 4 || buf[2] != 0 {
+			t.Errorf("unexpected datagram header %v", buf[:min(n, 4)])
+
+			continue
+		}
+
+		target, err := readAddr(&sliceReader{b: buf[3:n]})
+		if err != nil {
+			t.Error(err)
+
+			continue
+		}
+
+		header := 3 + addrLen(buf[3:n])
+		payload := buf[header:n]
+
+		s.targets <- target
+
+		packet := append(append(append([]byte{}, buf[:header]...), "echo:"...), payload...)
+
+		_, _ = relay.WriteTo(packet, from)
+	}
+
+	s.mx.Lock()
+	s.open--
+	s.mx.Unlock()
+}
+
+// dropControls closes the control connections of every association.
+func (s *testServer) dropControls() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, ctrl := range s.ctrls {
+		_ = ctrl.Close()
+	}
+}
+
+func (s *testServer) associations() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.open
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+
+	return n, nil
+}
+
+// readAddr reads ATYP, the address and the port of RFC 1928 section 5.
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+
+	switch atyp[0] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if atyp[0] == 4 {
+			ip = make(net.IP, 16)
+		}
+
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+
+		host = ip.String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+
+		host = string(name)
+	default:
+		return "", errors.New("unknown address type " + strconv.Itoa(int(atyp[0])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(int(atyp[0])) + " " + net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func addrLen(b []byte) int {
+	switch b[0] {
+	case 1:
+		return 1 + 4 + 2
+	case 4:
+		return 1 + 16 + 2
+	default:
+		return 1 + 1 + int(b[1]) + 2
+	}
+}
+
+func newTestProtocol(t *testing.T, s *testServer) *Protocol {
+	t.Helper()
+
+	p, err := New(&Config{Host: s.ln.Addr().String(), UDPTimeout: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestUDPHeader(t *testing.T) {
+	s := startServer(t)
+	p := newTestProtocol(t, s)
+
+	tests := []struct {
+		addr   string
+		target string
+	}{
+		{"192.0.2.1:53", "1 192.0.2.1:53"},
+		{"[2001:db8::1]:5353", "4 [2001:db8::1]:5353"},
+		{"db.corp.example.com:53", "3 db.corp.example.com:53"},
+	}
+
+	for _, tt := range tests {
+		conn, err := p.DialContext(context.Background(), "udp", tt.addr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.addr, err)
+		}
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("%s: %v", tt.addr, err)
+		}
+
+		if target := <-s.targets; target != tt.target {
+			t.Errorf("%s: server saw %s, want %s", tt.addr, target, tt.target)
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		buf := make([]byte, 64)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.addr, err)
+		}
+
+		if string(buf[:n]) != "echo:ping" {
+			t.Errorf("%s: got %q, want the payload without header", tt.addr, buf[:n])
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// waitAssociations waits until the server has n open associations.
+func waitAssociations(t *testing.T, s *testServer, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for s.associations() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("open associations: got %d, want %d", s.associations(), n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPAssociationPerFlow(t *testing.T) {
+	s := startServer(t)
+	p := newTestProtocol(t, s)
+
+	first, err := p.DialContext(context.Background(), "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := p.DialContext(context.Background(), "udp", "192.0.2.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitAssociations(t, s, 2)
+
+	if first.(*udpConn).RemoteAddr().String() == second.(*udpConn).RemoteAddr().String() {
+		t.Fatal("flows share a relay")
+	}
+
+	// Closing a flow ends its control connection and so its association.
+	_ = first.Close()
+
+	waitAssociations(t, s, 1)
+
+	// The flow ends when the server drops the control connection.
+	s.dropControls()
+
+	_ = second.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := second.Read(make([]byte, 64)); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read after the control connection closed: got %v", err)
+	}
+
+	waitAssociations(t, s, 0)
+}
@@ -0,0 +1,20 @@
+//go:build darwin
+
+package ssh
+
+import (
+	"os/user"
+	"strings"
+
+	"github.com/merzzzl/warp/internal/utils/sys"
+)
+
+// userAgentSocket asks launchd for the agent of the session of usr.
+func userAgentSocket(usr *user.User) string {
+	out, err := sys.Command("launchctl", "asuser", usr.Uid, "launchctl", "getenv", "SSH_AUTH_SOCK")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(out)
+}
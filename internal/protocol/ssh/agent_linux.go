@@ -0,0 +1,31 @@
+//go:build linux
+
+package ssh
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// agentSockets are the places agents of desktop sessions listen at, relative to the runtime dir.
+var agentSockets = []string{
+	"ssh-agent.socket",
+	"openssh_agent",
+	"keyring/ssh",
+	"gcr/ssh",
+	"gnupg/S.gpg-agent.ssh",
+}
+
+// userAgentSocket looks for an agent in the runtime dir of usr.
+func userAgentSocket(usr *user.User) string {
+	for _, name := range agentSockets {
+		path := filepath.Join("/run/user", usr.Uid, name)
+
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			return path
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,368 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+const (
+	authPublicKey   = "publickey"
+	authAgent       = "agent"
+	authKeyboard    = "keyboard-interactive"
+	authPassword    = "password"
+	certificateFile = "-cert.pub"
+)
+
+var (
+	errAuthMethod  = errors.New("unknown ssh auth method")
+	errNoAuth      = errors.New("no ssh auth method configured")
+	errCertificate = errors.New("not an ssh certificate")
+	errUnattended  = errors.New("ssh server asks for input while reconnecting, use a key, the agent or a password")
+)
+
+// authMethods returns the auth methods of cfg in the configured order. Keys of
+// the identity file and of the agent are offered by a single publickey method,
+// the ssh client tries every method name only once. Keyboard-interactive auth
+// fails instead of prompting while unattended reports true.
+func authMethods(cfg *Config, unattended func() bool) ([]ssh.AuthMethod, error) {
+	order := cfg.Auth
+	if len(order) == 0 {
+		order = defaultAuthOrder(cfg)
+	}
+
+	var (
+		methods []ssh.AuthMethod
+		sources []func() ([]ssh.Signer, error)
+	)
+
+	for _, name := range order {
+		switch name {
+		case authPublicKey:
+			signers, err := identitySigners(cfg)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, func() ([]ssh.Signer, error) {
+				return signers, nil
+			})
+		case authAgent:
+			socket := agentSocket(cfg)
+			if socket == "" {
+				log.Debug().Msg("SSH", "ssh agent not found")
+
+				continue
+			}
+
+			sources = append(sources, func() ([]ssh.Signer, error) {
+				return agentSigners(socket)
+			})
+		case authKeyboard:
+			methods = append(methods, ssh.KeyboardInteractive(keyboardChallenge(cfg.Password, unattended)))
+		case authPassword:
+			methods = append(methods, ssh.Password(cfg.Password))
+		default:
+			return nil, fmt.Errorf("%w: %s", errAuthMethod, name)
+		}
+
+		if len(sources) == 1 && (name == authPublicKey || name == authAgent) {
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return collectSigners(sources)
+			}))
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, errNoAuth
+	}
+
+	return methods, nil
+}
+
+func defaultAuthOrder(cfg *Config) []string {
+	order := []string{authAgent}
+
+	if cfg.IdentityFile != "" {
+		order = append(order, authPublicKey)
+	}
+
+	if cfg.Password != "" {
+		order = append(order, authPassword)
+	}
+
+	return order
+}
+
+func collectSigners(sources []func() ([]ssh.Signer, error)) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	for _, source := range sources {
+		list, err := source()
+		if err != nil {
+			log.Warn().Err(err).Msg("SSH", "skip ssh keys")
+
+			continue
+		}
+
+		signers = append(signers, list...)
+	}
+
+	return signers, nil
+}
+
+// identitySigners loads the identity file, offering its certificate first if there is one.
+// Only files set in the warp config have to exist.
+func identitySigners(cfg *Config) ([]ssh.Signer, error) {
+	if cfg.IdentityFile == "" {
+		return nil, fmt.Errorf("%w: identity_file is required for %s", errNoAuth, authPublicKey)
+	}
+
+	path := expandPath(cfg.IdentityFile)
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		if cfg.identityOptional && errors.Is(err, os.ErrNotExist) {
+			log.Debug().Str("file", path).Msg("SSH", "skip missing identity file of ssh config")
+
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		var passphrase []byte
+
+		passphrase, err = readPassphrase(cfg, path)
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("identity file %s: %w", path, err)
+	}
+
+	certPath := path + certificateFile
+	if cfg.Certificate != "" {
+		certPath = expandPath(cfg.Certificate)
+	}
+
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		if (cfg.Certificate == "" || cfg.certificateOptional) && errors.Is(err, os.ErrNotExist) {
+			return []ssh.Signer{signer}, nil
+		}
+
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", certPath, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errCertificate, certPath)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("certificate %s: %w", certPath, err)
+	}
+
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+func readPassphrase(cfg *Config, path string) ([]byte, error) {
+	if cfg.PassphraseFile != "" {
+		passphrase, err := os.ReadFile(expandPath(cfg.PassphraseFile))
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strings.TrimRight(string(passphrase), "\r\n")), nil
+	}
+
+	answer, err := prompt(fmt.Sprintf("Enter passphrase for %s: ", path), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(answer), nil
+}
+
+// agentSigners asks the agent for its keys, a new connection is used every time
+// so a restarted agent is picked up on reconnect.
+func agentSigners(socket string) ([]ssh.Signer, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	// The signers keep using conn, so they are wrapped to dial the agent on every signature.
+	list := make([]ssh.Signer, 0, len(signers))
+	for _, signer := range signers {
+		list = append(list, &agentSigner{socket: socket, pub: signer.PublicKey()})
+	}
+
+	return list, nil
+}
+
+type agentSigner struct {
+	socket string
+	pub    ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(_ io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(nil, data, "")
+}
+
+func (s *agentSigner) SignWithAlgorithm(_ io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	client := agent.NewClient(conn)
+
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		return client.SignWithFlags(s.pub, data, agent.SignatureFlagRsaSha256)
+	case ssh.KeyAlgoRSASHA512, ssh.CertAlgoRSASHA512v01:
+		return client.SignWithFlags(s.pub, data, agent.SignatureFlagRsaSha512)
+	default:
+		return client.Sign(s.pub, data)
+	}
+}
+
+// agentSocket returns the agent of the configuration, of the environment or of
+// the user that invoked sudo.
+func agentSocket(cfg *Config) string {
+	if cfg.AgentSocket != "" {
+		return expandPath(cfg.AgentSocket)
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		return socket
+	}
+
+	usr, err := invokingUser()
+	if err != nil {
+		return ""
+	}
+
+	return userAgentSocket(usr)
+}
+
+func keyboardChallenge(password string, unattended func() bool) ssh.KeyboardInteractiveChallenge {
+	return func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+		if instruction != "" && len(questions) != 0 {
+			log.Info().Msg("SSH", instruction)
+		}
+
+		answers := make([]string, len(questions))
+
+		for i, question := range questions {
+			if password != "" && strings.Contains(strings.ToLower(question), "password") {
+				answers[i] = password
+
+				continue
+			}
+
+			if unattended() {
+				return nil, errUnattended
+			}
+
+			answer, err := prompt(question, echos[i])
+			if err != nil {
+				return nil, err
+			}
+
+			answers[i] = answer
+		}
+
+		return answers, nil
+	}
+}
+
+// prompt asks the controlling terminal, stdin may be taken by the TUI.
+func prompt(question string, echo bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("prompt %q: %w", question, err)
+	}
+
+	defer tty.Close()
+
+	if _, err := fmt.Fprint(tty, question); err != nil {
+		return "", err
+	}
+
+	if echo {
+		line, err := bufio.NewReader(tty).ReadString('\n')
+
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	answer, err := term.ReadPassword(int(tty.Fd()))
+
+	_, _ = fmt.Fprintln(tty)
+
+	return string(answer), err
+}
+
+// invokingUser returns the user that ran warp through sudo, or the current one.
+func invokingUser() (*user.User, error) {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return user.Lookup(name)
+	}
+
+	return user.Current()
+}
+
+// expandPath resolves ~ against the home of the invoking user.
+func expandPath(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	usr, err := invokingUser()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(usr.HomeDir, strings.TrimPrefix(path, "~"))
+}
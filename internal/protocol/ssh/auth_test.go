@@ -0,0 +1,290 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func keyName(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	pub, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ssh.FingerprintSHA256(pub)
+}
+
+// writeKey stores key as OpenSSH private key file in dir.
+func writeKey(t *testing.T, dir string, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeFile(t, dir, "id_ed25519", string(pem.EncodeToMemory(block)))
+}
+
+// startAgent serves an ssh agent holding key on a socket in dir.
+func startAgent(t *testing.T, dir string, key ed25519.PrivateKey) string {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socket
+}
+
+// attempts runs the auth methods of cfg against a server that rejects
+// everything and returns the methods and keys in the order they were tried.
+func attempts(t *testing.T, cfg *Config) []string {
+	t.Helper()
+
+	methods, err := authMethods(cfg, func() bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		tried []string
+		mx    sync.Mutex
+	)
+
+	try := func(attempt string) {
+		mx.Lock()
+		defer mx.Unlock()
+
+		tried = append(tried, attempt)
+	}
+
+	srvCfg := &ssh.ServerConfig{
+		MaxAuthTries: -1,
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			try("password " + string(password))
+
+			return nil, errors.New("denied")
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			try("publickey " + ssh.FingerprintSHA256(key))
+
+			return nil, errors.New("denied")
+		},
+		KeyboardInteractiveCallback: func(_ ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			try(fmt.Sprintf("keyboard-interactive %q %v", answers, err))
+
+			return nil, errors.New("denied")
+		},
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvCfg.AddHostKey(hostKey)
+
+	// Both ends write their version first, net.Pipe would block them.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		server, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer server.Close()
+
+		_, _, _, _ = ssh.NewServerConn(server, srvCfg)
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = ssh.NewClientConn(client, "test", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            methods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("auth succeeded")
+	}
+
+	client.Close()
+	<-done
+
+	return tried
+}
+
+func TestAuthOrder(t *testing.T) {
+	dir := t.TempDir()
+	fileKey, agentKey := newKey(t), newKey(t)
+	identity := writeKey(t, dir, fileKey)
+	socket := startAgent(t, dir, agentKey)
+
+	file := "publickey " + keyName(t, fileKey)
+	agentPub := "publickey " + keyName(t, agentKey)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{
+			name: "default",
+			cfg:  Config{IdentityFile: identity, AgentSocket: socket, Password: "secret"},
+			want: []string{agentPub, file, "password secret"},
+		},
+		{
+			name: "configured",
+			cfg: Config{
+				IdentityFile: identity,
+				AgentSocket:  socket,
+				Password:     "secret",
+				Auth:         []string{authKeyboard, authPublicKey, authPassword, authAgent},
+			},
+			want: []string{`keyboard-interactive ["secret"] <nil>`, file, agentPub, "password secret"},
+		},
+		{
+			// The client hangs up instead of prompting.
+			name: "unattended keyboard",
+			cfg:  Config{Auth: []string{authKeyboard}},
+			want: []string{"keyboard-interactive [] EOF"},
+		},
+		{
+			name: "missing key of ssh config",
+			cfg: Config{
+				IdentityFile:     filepath.Join(dir, "missing"),
+				AgentSocket:      socket,
+				identityOptional: true,
+			},
+			want: []string{agentPub},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := attempts(t, &tt.cfg); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: tried %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthMethodsErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		cfg  Config
+		want error
+	}{
+		{Config{Auth: []string{"hostbased"}}, errAuthMethod},
+		{Config{Auth: []string{authPublicKey}}, errNoAuth},
+		{Config{IdentityFile: filepath.Join(dir, "missing")}, os.ErrNotExist},
+		{Config{IdentityFile: writeKey(t, dir, newKey(t)), Certificate: filepath.Join(dir, "missing-cert.pub")}, os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		if _, err := authMethods(&tt.cfg, func() bool { return true }); !errors.Is(err, tt.want) {
+			t.Errorf("%+v: got %v, want %v", tt.cfg, err, tt.want)
+		}
+	}
+
+	// Files of the OpenSSH config may be missing.
+	cfg := Config{
+		IdentityFile:        writeKey(t, dir, newKey(t)),
+		Certificate:         filepath.Join(dir, "missing-cert.pub"),
+		certificateOptional: true,
+	}
+
+	if _, err := authMethods(&cfg, func() bool { return true }); err != nil {
+		t.Errorf("missing certificate of ssh config: %v", err)
+	}
+}
+
+func TestApplySSHConfigOptionalFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, dir, "config", "Host db\n  IdentityFile ~/.ssh/id_db\n  CertificateFile ~/.ssh/id_db-cert.pub\n")
+
+	cfg, err := applySSHConfig(&Config{Alias: "db", SSHConfig: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.identityOptional || !cfg.certificateOptional {
+		t.Fatalf("files of ssh config are required: %+v", cfg)
+	}
+
+	cfg, err = applySSHConfig(&Config{Alias: "db", SSHConfig: path, IdentityFile: "~/.ssh/id_warp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.identityOptional || !cfg.certificateOptional {
+		t.Fatalf("identity file of warp config is optional: %+v", cfg)
+	}
+}
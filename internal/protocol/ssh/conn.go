@@ -0,0 +1,256 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+var (
+	defaultKeepAlive    = 15 * time.Second
+	defaultKeepAliveMax = 3
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+	reconnectWait       = 30 * time.Second
+	errReconnecting     = errors.New("ssh connection is being reopened")
+)
+
+// client returns the connected client, waiting for a reconnect in progress.
+func (p *Protocol) client(ctx context.Context) (*ssh.Client, error) {
+	timer := time.NewTimer(reconnectWait)
+	defer timer.Stop()
+
+	for {
+		p.mx.Lock()
+		cli, ready := p.cli, p.ready
+		p.mx.Unlock()
+
+		if cli != nil {
+			return cli, nil
+		}
+
+		if p.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+
+		select {
+		case <-ready:
+		case <-timer.C:
+			return nil, errReconnecting
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// DialContext opens a channel to addr, a dead transport is reopened and the
+// dial retried once on the new connection.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	for i := 0; ; i++ {
+		cli, err := p.client(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Debug().Str("attempt", strconv.Itoa(i)).Str("dest", addr).Str("type", n).Msg("SSH", "open dial")
+
+		conn, err := cli.Dial(n, addr)
+
+		var openErr *ssh.OpenChannelError
+		if err == nil || i == 1 || errors.As(err, &openErr) {
+			return conn, err
+		}
+
+		log.Warn().Str("dest", addr).Str("type", n).Str("url", p.target().String()).Err(err).Msg("SSH", "reopen connection")
+
+		p.broken(cli)
+	}
+}
+
+func (p *Protocol) dial(n, addr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), n, addr)
+}
+
+func (p *Protocol) target() *hop {
+	return p.hops[len(p.hops)-1]
+}
+
+// setChain makes chain the connection of the protocol and releases the callers
+// waiting for it, a chain opened during shutdown is closed instead.
+func (p *Protocol) setChain(chain []*ssh.Client) {
+	cli := chain[len(chain)-1]
+
+	p.mx.Lock()
+
+	if p.ctx.Err() != nil {
+		p.mx.Unlock()
+
+		closeChain(chain)
+
+		return
+	}
+
+	p.chain = chain
+	p.cli = cli
+
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+
+	close(p.ready)
+	p.mx.Unlock()
+
+	go p.watch(cli)
+}
+
+// broken drops cli and reconnects in the background, unless that already
+// happened or the protocol is shutting down.
+func (p *Protocol) broken(cli *ssh.Client) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.cli != cli || p.ctx.Err() != nil {
+		return
+	}
+
+	closeChain(p.chain)
+
+	p.chain = nil
+	p.cli = nil
+	p.ready = make(chan struct{})
+
+	go p.reconnect()
+}
+
+// reconnect opens a new connection until it succeeds or the protocol shuts
+// down. Nobody is there to answer prompts, so only unattended auth is used.
+func (p *Protocol) reconnect() {
+	backoff := reconnectMinBackoff
+
+	for {
+		chain, err := connect(p.ctx, p.hops, p.forward, true)
+		if err == nil {
+			log.Info().Str("url", p.target().String()).Msg("SSH", "connection reopened")
+
+			p.setChain(chain)
+
+			return
+		}
+
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		log.Error().Str("url", p.target().String()).Str("retry", backoff.String()).Err(err).Msg("SSH", "failed to open ssh session")
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-p.ctx.Done():
+			timer.Stop()
+
+			return
+		case <-timer.C:
+		}
+
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// close shuts the connection down for good.
+func (p *Protocol) close() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	closeChain(p.chain)
+
+	p.chain = nil
+	p.cli = nil
+}
+
+// watch reconnects as soon as the transport of cli dies or stops answering keepalives.
+func (p *Protocol) watch(cli *ssh.Client) {
+	done := make(chan struct{})
+
+	go func() {
+		_ = cli.Wait()
+
+		close(done)
+	}()
+
+	if p.keepAlive > 0 {
+		go p.keepAliveLoop(cli, done)
+	}
+
+	<-done
+
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	log.Warn().Str("url", p.target().String()).Msg("SSH", "connection lost")
+
+	p.broken(cli)
+}
+
+func (p *Protocol) keepAliveLoop(cli *ssh.Client, done <-chan struct{}) {
+	ticker := time.NewTicker(p.keepAlive)
+	defer ticker.Stop()
+
+	var missed int
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if p.ping(cli) {
+			missed = 0
+
+			continue
+		}
+
+		missed++
+
+		log.Debug().Str("url", p.target().String()).Str("missed", strconv.Itoa(missed)).Msg("SSH", "keepalive missed")
+
+		if missed >= p.keepAliveMax {
+			log.Warn().Str("url", p.target().String()).Msg("SSH", "keepalive timeout")
+
+			_ = cli.Close()
+
+			return
+		}
+	}
+}
+
+// ping sends a keepalive, any reply including a failure proves the server is alive.
+func (p *Protocol) ping(cli *ssh.Client) bool {
+	reply := make(chan error, 1)
+
+	go func() {
+		_, _, err := cli.SendRequest(keepAliveRequest, true, nil)
+
+		reply <- err
+	}()
+
+	timer := time.NewTimer(p.keepAlive)
+	defer timer.Stop()
+
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
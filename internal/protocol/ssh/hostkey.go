@@ -0,0 +1,249 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+const (
+	hostKeyStrict = "strict"
+	hostKeyTOFU   = "tofu"
+
+	knownHostsFile   = "~/.ssh/known_hosts"
+	globalKnownHosts = "/etc/ssh/ssh_known_hosts"
+)
+
+var (
+	errHostKeyMismatch = errors.New("ssh host key mismatch, the host may be impersonated")
+	errHostKeyUnknown  = errors.New("ssh host key unknown, add it to known_hosts or set host_key_check: tofu")
+	errHostKeyRevoked  = errors.New("ssh host key revoked")
+	errHostKeyMode     = errors.New("unknown host_key_check mode")
+)
+
+// algorithmsByKeyType lists the host key algorithms that verify a key of the given type.
+var algorithmsByKeyType = map[string][]string{
+	ssh.KeyAlgoRSA:      {ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+	ssh.KeyAlgoED25519:  {ssh.KeyAlgoED25519},
+	ssh.KeyAlgoECDSA256: {ssh.KeyAlgoECDSA256},
+	ssh.KeyAlgoECDSA384: {ssh.KeyAlgoECDSA384},
+	ssh.KeyAlgoECDSA521: {ssh.KeyAlgoECDSA521},
+}
+
+var certAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01,
+}
+
+type hostKeyChecker struct {
+	mode   string
+	pinned string
+	files  []string
+	mx     sync.Mutex
+}
+
+func newHostKeyChecker(cfg *Config) (*hostKeyChecker, error) {
+	mode := cfg.HostKeyCheck
+	if mode == "" {
+		mode = hostKeyStrict
+	}
+
+	if mode != hostKeyStrict && mode != hostKeyTOFU {
+		return nil, fmt.Errorf("%w: %s", errHostKeyMode, mode)
+	}
+
+	file := knownHostsFile
+	if cfg.KnownHosts != "" {
+		file = cfg.KnownHosts
+	}
+
+	return &hostKeyChecker{
+		mode:   mode,
+		pinned: strings.TrimSpace(cfg.HostKey),
+		files:  []string{expandPath(file), globalKnownHosts},
+	}, nil
+}
+
+// callback reloads known_hosts for every connection, so keys recorded on first
+// use are known on reconnect.
+func (c *hostKeyChecker) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if c.pinned != "" {
+		return c.checkPinned(hostname, key)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	check, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	err = check(hostname, remote, key)
+
+	// Like OpenSSH, a certificate without a known authority is checked as a plain key.
+	if cert, ok := key.(*ssh.Certificate); ok && err != nil && !errors.As(err, new(*knownhosts.RevokedError)) {
+		key = cert.Key
+		err = check(hostname, remote, key)
+	}
+
+	var (
+		keyErr     *knownhosts.KeyError
+		revokedErr *knownhosts.RevokedError
+	)
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &revokedErr):
+		return fmt.Errorf("%w: %s %s", errHostKeyRevoked, hostname, revokedErr.Revoked.String())
+	case errors.As(err, &keyErr) && len(keyErr.Want) != 0:
+		want := make([]string, 0, len(keyErr.Want))
+		for _, known := range keyErr.Want {
+			want = append(want, fmt.Sprintf("%s %s (%s:%d)", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+		}
+
+		return fmt.Errorf("%w: %s offered %s %s, known_hosts has %s", errHostKeyMismatch, hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(want, ", "))
+	case errors.As(err, &keyErr) && c.mode == hostKeyTOFU:
+		return c.record(hostname, key)
+	case errors.As(err, &keyErr):
+		return fmt.Errorf("%w: %s %s %s", errHostKeyUnknown, hostname, key.Type(), ssh.FingerprintSHA256(key))
+	default:
+		return err
+	}
+}
+
+func (c *hostKeyChecker) checkPinned(hostname string, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	if strings.HasPrefix(c.pinned, "SHA256:") {
+		if ssh.FingerprintSHA256(key) == c.pinned {
+			return nil
+		}
+	} else {
+		pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(c.pinned))
+		if err != nil {
+			return fmt.Errorf("parse host_key: %w", err)
+		}
+
+		if string(pinned.Marshal()) == string(key.Marshal()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s offered %s %s, host_key is %s", errHostKeyMismatch, hostname, key.Type(), ssh.FingerprintSHA256(key), c.pinned)
+}
+
+func (c *hostKeyChecker) load() (ssh.HostKeyCallback, error) {
+	var files []string
+
+	for _, file := range c.files {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	return knownhosts.New(files...)
+}
+
+// record appends key of hostname to the known_hosts of the user.
+func (c *hostKeyChecker) record(hostname string, key ssh.PublicKey) error {
+	file := c.files[0]
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return err
+	}
+
+	// warp runs under sudo, the file must stay usable by the user.
+	if uid, gid, ok := sudoOwner(); ok {
+		_ = os.Chown(filepath.Dir(file), uid, gid)
+		_ = f.Chown(uid, gid)
+	}
+
+	log.Warn().Str("host", hostname).Str("key", ssh.FingerprintSHA256(key)).Str("file", file).Msg("SSH", "trust host key on first use")
+
+	return nil
+}
+
+// algorithms returns the host key algorithms of the keys known for hostname, so
+// the server does not pick a key type known_hosts has no entry for. Host
+// certificates come first as known keys may be authorities. Without known keys
+// the defaults are used.
+func (c *hostKeyChecker) algorithms(hostname string) []string {
+	if c.pinned != "" {
+		return nil
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	check, err := c.load()
+	if err != nil {
+		return nil
+	}
+
+	placeholder, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(hostname, &net.TCPAddr{IP: net.IPv4zero}, placeholder), &keyErr) {
+		return nil
+	}
+
+	if len(keyErr.Want) == 0 {
+		return nil
+	}
+
+	algos := append([]string(nil), certAlgorithms...)
+
+	for _, known := range keyErr.Want {
+		algos = append(algos, algorithmsByKeyType[known.Key.Type()]...)
+	}
+
+	return algos
+}
+
+func sudoOwner() (int, int, bool) {
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return uid, gid, true
+}
@@ -3,11 +3,8 @@ package ssh
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -16,115 +13,124 @@ import (
 
 	"github.com/merzzzl/warp/internal/utils/log"
 	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/tlsconf"
+	"github.com/merzzzl/warp/internal/utils/upstream"
 )
 
 type Config struct {
-	User     string   `yaml:"user"`
-	Password string   `yaml:"password"`
-	Host     string   `yaml:"host"`
-	Domains  []string `yaml:"domains"`
-	IPs      []string `yaml:"ips"`
-	DNS      []string `yaml:"dns"`
+	User           string          `yaml:"user"`
+	Password       string          `yaml:"password"`
+	IdentityFile   string          `yaml:"identity_file"`
+	PassphraseFile string          `yaml:"passphrase_file"`
+	Certificate    string          `yaml:"certificate"`
+	AgentSocket    string          `yaml:"agent_socket"`
+	Auth           []string        `yaml:"auth"`
+	Host           string          `yaml:"host"`
+	Port           int             `yaml:"port"`
+	Alias          string          `yaml:"alias"`
+	SSHConfig      string          `yaml:"ssh_config"`
+	HostKey        string          `yaml:"host_key"`
+	HostKeyCheck   string          `yaml:"host_key_check"`
+	KnownHosts     string          `yaml:"known_hosts"`
+	Jump           []*Config       `yaml:"jump"`
+	TLS            *tlsconf.Config `yaml:"tls"`
+	KeepAlive      time.Duration   `yaml:"keepalive"`
+	KeepAliveMax   int             `yaml:"keepalive_max"`
+	UDP            bool            `yaml:"udp"`
+	UDPHelper      string          `yaml:"udp_helper"`
+	UDPTimeout     time.Duration   `yaml:"udp_timeout"`
+	Domains        []string        `yaml:"domains"`
+	IPs            []string        `yaml:"ips"`
+	DNS            []string        `yaml:"dns"`
+	IPv6           *bool           `yaml:"ipv6"`
+
+	// identityOptional and certificateOptional mark files taken from the OpenSSH
+	// config, a missing one is skipped like OpenSSH does.
+	identityOptional    bool
+	certificateOptional bool
 }
 
+var (
+	defaultPort = 22
+	errNoHost   = errors.New("ssh host or alias is required")
+)
+
 type Protocol struct {
-	host    string
-	config  *ssh.ClientConfig
-	cli     *ssh.Client
-	domains []string
-	dns     []string
-	ips     []string
-	mx      sync.Mutex
+	ctx          context.Context
+	forward      network.DialFunc
+	hops         []*hop
+	chain        []*ssh.Client
+	cli          *ssh.Client
+	ready        chan struct{}
+	keepAlive    time.Duration
+	keepAliveMax int
+	udp          *udpRelay
+	domains      []string
+	dns          []*upstream.Upstream
+	ips          []string
+	ipv6         bool
+	mx           sync.Mutex
 }
 
-func New(cfg *Config) (*Protocol, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: cfg.User,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(cfg.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         time.Second * 5,
+// New connects to the server, dial reaches the first hop and is the host network if nil.
+// The connection is kept open, and reopened when it dies, until ctx is done.
+func New(ctx context.Context, cfg *Config, dial network.DialFunc) (*Protocol, error) {
+	if dial == nil {
+		dial = network.Direct
 	}
 
-	log.Debug().Str("url", fmt.Sprintf("%s@%s", sshConfig.User, cfg.Host)).Msg("SSH", "open connection")
-
-	cli, err := ssh.Dial("tcp", cfg.Host+":22", sshConfig)
+	hops, err := newHops(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	var dnsList []string
-
-	if len(cfg.DNS) != 0 {
-		dnsList = cfg.DNS
-	} else {
-		log.Debug().Str("url", fmt.Sprintf("%s@%s", sshConfig.User, cfg.Host)).Msg("SSH", "get dns servers")
-
-		session, err := cli.NewSession()
-		if err != nil {
-			return nil, err
-		}
-
-		defer session.Close()
-
-		sshDNS, err := session.CombinedOutput("scutil --dns | grep \"nameserver\\[.\\]\" | awk '{print $3}' | head -n 1")
-		if err != nil {
-			return nil, err
-		}
-
-		if len(sshDNS) != 0 {
-			dnsList = append(dnsList, strings.TrimSpace(string(sshDNS)))
-		}
+	chain, err := connect(ctx, hops, dial, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Protocol{
-		host:    cfg.Host,
-		config:  sshConfig,
-		dns:     dnsList,
-		cli:     cli,
-		domains: cfg.Domains,
-		ips:     cfg.IPs,
-	}, nil
-}
+	cli := chain[len(chain)-1]
 
-func (p *Protocol) dial(n, addr string) (net.Conn, error) {
-	for i := 0; ; i++ {
-		log.Debug().Str("attempt", strconv.Itoa(i)).Str("dest", addr).Str("type", n).Msg("SSH", "open dial")
+	dnsList := cfg.DNS
+	if len(dnsList) == 0 {
+		log.Debug().Str("url", hops[len(hops)-1].String()).Msg("SSH", "get dns servers")
 
-		conn, err := p.cli.Dial(n, addr)
-		if err == nil || i == 2 {
-			return conn, err
-		}
-
-		if _, ok := err.(net.Error); ok {
-			return nil, err
-		}
-
-		log.Warn().Str("dest", addr).Str("type", n).Str("url", fmt.Sprintf("%s@%s", p.config.User, p.host)).Err(err).Msg("SSH", "reopen connection")
-
-		if !p.mx.TryLock() {
-			time.Sleep(1 * time.Second)
+		dnsList = remoteDNS(cli)
+	}
 
-			continue
-		}
+	p := &Protocol{
+		ctx:          ctx,
+		forward:      dial,
+		hops:         hops,
+		keepAlive:    defaultKeepAlive,
+		keepAliveMax: defaultKeepAliveMax,
+		domains:      cfg.Domains,
+		ips:          cfg.IPs,
+		ipv6:         cfg.IPv6 != nil && *cfg.IPv6,
+	}
 
-		cli, err := ssh.Dial("tcp", p.host+":22", p.config)
-		if err != nil {
-			log.Error().Err(err).Msg("SSH", "failed to open ssh session")
+	if cfg.KeepAlive != 0 {
+		p.keepAlive = cfg.KeepAlive
+	}
 
-			p.mx.Unlock()
+	if cfg.KeepAliveMax > 0 {
+		p.keepAliveMax = cfg.KeepAliveMax
+	}
 
-			return nil, err
-		}
+	if cfg.UDP {
+		p.udp = newUDPRelay(p, cfg)
+	}
 
-		_ = p.cli.Close()
-		p.cli = cli
+	p.setChain(chain)
 
-		p.mx.Unlock()
+	context.AfterFunc(ctx, p.close)
 
-		time.Sleep(1 * time.Second)
+	p.dns, err = upstream.NewList(dnsList, "tcp", p.DialContext)
+	if err != nil {
+		return nil, err
 	}
+
+	return p, nil
 }
 
 func (p *Protocol) Domains() []string {
@@ -135,42 +141,19 @@ func (p *Protocol) FixedIPs() []string {
 	return p.ips
 }
 
-func (p *Protocol) LookupHost(_ context.Context, req *dns.Msg) *dns.Msg {
-	for _, addr := range p.dns {
-		dnsConn, err := p.dial("tcp", addr+":53")
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SSH", "handle dns req")
-
-			continue
-		}
-
-		co := new(dns.Conn)
-		co.Conn = dnsConn
-
-		err = co.WriteMsg(req)
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SSH", "write dns req")
-
-			continue
-		}
-
-		rsp, err := co.ReadMsg()
-		if err != nil {
-			log.Error().Str("server", addr).DNS(req).Err(err).Msg("SSH", "read dns req")
-
-			continue
-		}
-
-		log.Debug().Str("server", addr).DNS(req).Msg("SSH", "handle dns req")
-
-		if len(rsp.Answer) == 0 {
-			continue
-		}
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
 
-		return rsp
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
 	}
 
-	return req
+	log.Debug().DNS(req).Msg("SSH", "handle dns req")
+
+	return rsp, nil
 }
 
 func (p *Protocol) HandleTCP(conn net.Conn) {
@@ -187,3 +170,17 @@ func (p *Protocol) HandleTCP(conn net.Conn) {
 
 	network.Transfer("SSH", conn, remoteConn)
 }
+
+func (p *Protocol) HandleUDP(conn net.Conn) {
+	if p.udp == nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Msg("SSH", "udp relay is disabled, set udp: true")
+
+		return
+	}
+
+	log.Info().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Msg("SSH", "handle conn")
+
+	if err := p.udp.handle(conn); err != nil {
+		log.Warn().Str("dest", conn.LocalAddr().String()).Str("type", conn.LocalAddr().Network()).Err(err).Msg("SSH", "handle conn")
+	}
+}
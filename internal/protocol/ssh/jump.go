@@ -0,0 +1,236 @@
+package ssh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/tlsconf"
+)
+
+const maxJumps = 8
+
+var errJumpDepth = errors.New("ssh jump chain too long")
+
+// hop is one host of the chain to the ssh server, with its own auth and host key settings.
+type hop struct {
+	addr   string
+	config *ssh.ClientConfig
+	tls    *tls.Config
+	// unattended is set while the hop is dialed by a background reconnect.
+	unattended atomic.Bool
+}
+
+// newHops returns the jump hosts of cfg, jumps of jumps first, followed by cfg itself.
+func newHops(cfg *Config) ([]*hop, error) {
+	configs, err := jumpChain(cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hops := make([]*hop, 0, len(configs))
+
+	for _, c := range configs {
+		h, err := newHop(c)
+		if err != nil {
+			return nil, err
+		}
+
+		hops = append(hops, h)
+	}
+
+	return hops, nil
+}
+
+func jumpChain(cfg *Config, depth int) ([]*Config, error) {
+	if depth > maxJumps {
+		return nil, errJumpDepth
+	}
+
+	cfg, err := applySSHConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*Config
+
+	for _, jump := range cfg.Jump {
+		j := *jump
+		setDefault(&j.SSHConfig, cfg.SSHConfig)
+
+		hops, err := jumpChain(&j, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, hops...)
+	}
+
+	return append(chain, cfg), nil
+}
+
+// parseProxyJump turns the [user@]host[:port] list of ProxyJump into jump configs,
+// the hosts are aliases of the same OpenSSH config.
+func parseProxyJump(value, sshConfig string) ([]*Config, error) {
+	if value == "" || value == "none" {
+		return nil, nil
+	}
+
+	var jumps []*Config
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), "ssh://")
+
+		jump := &Config{SSHConfig: sshConfig}
+
+		if i := strings.LastIndex(entry, "@"); i >= 0 {
+			jump.User = entry[:i]
+			entry = entry[i+1:]
+		}
+
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			jump.Port, err = strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("proxy jump %s: %w", entry, err)
+			}
+
+			entry = host
+		}
+
+		jump.Alias = entry
+		jumps = append(jumps, jump)
+	}
+
+	return jumps, nil
+}
+
+func newHop(cfg *Config) (*hop, error) {
+	if cfg.Host == "" {
+		return nil, errNoHost
+	}
+
+	port := defaultPort
+	if cfg.Port != 0 {
+		port = cfg.Port
+	}
+
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+
+	h := &hop{addr: addr}
+
+	auth, err := authMethods(cfg, h.unattended.Load)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+
+	hostKeys, err := newHostKeyChecker(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+
+	h.config = &ssh.ClientConfig{
+		User:              cfg.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys.callback,
+		HostKeyAlgorithms: hostKeys.algorithms(addr),
+		Timeout:           time.Second * 5,
+	}
+
+	if cfg.TLS != nil {
+		h.tls, err = tlsconf.New(cfg.TLS, addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+	}
+
+	return h, nil
+}
+
+func (h *hop) String() string {
+	return fmt.Sprintf("%s@%s", h.config.User, h.addr)
+}
+
+// dial connects to the hop with dial, wrapping the connection in TLS first if
+// the hop has a tls block. Without a user to answer prompts, unattended is set.
+func (h *hop) dial(ctx context.Context, dial network.DialFunc, unattended bool) (*ssh.Client, error) {
+	log.Debug().Str("url", h.String()).Msg("SSH", "open connection")
+
+	dialCtx, cancel := context.WithTimeout(ctx, h.config.Timeout)
+	defer cancel()
+
+	h.unattended.Store(unattended)
+
+	conn, err := dial(dialCtx, "tcp", h.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.tls != nil {
+		conn, err = tlsconf.Client(dialCtx, conn, h.tls)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The handshake does not take a context, closing the conn interrupts it. A
+	// user answering prompts gets as long as it takes.
+	if unattended {
+		ctx = dialCtx
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, h.addr, h.config)
+	if !stop() && err == nil {
+		_ = c.Close()
+
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// connect dials the first hop with dial and every other hop through the client
+// of the previous one.
+func connect(ctx context.Context, hops []*hop, dial network.DialFunc, unattended bool) ([]*ssh.Client, error) {
+	chain := make([]*ssh.Client, 0, len(hops))
+
+	for _, h := range hops {
+		cli, err := h.dial(ctx, dial, unattended)
+		if err != nil {
+			closeChain(chain)
+
+			return nil, fmt.Errorf("%s: %w", h, err)
+		}
+
+		chain = append(chain, cli)
+		dial = cli.DialContext
+	}
+
+	return chain, nil
+}
+
+// closeChain closes the clients from the ssh server back to the first jump host.
+func closeChain(chain []*ssh.Client) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		_ = chain[i].Close()
+	}
+}
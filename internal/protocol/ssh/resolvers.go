@@ -0,0 +1,140 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+// fallbackDNS is the systemd-resolved stub, dialed on the loopback of the server.
+const fallbackDNS = "127.0.0.53"
+
+type resolverSource struct {
+	name  string
+	cmd   string
+	parse func(out []byte) []string
+}
+
+var resolverSources = []resolverSource{
+	{name: "resolvectl", cmd: "resolvectl dns", parse: parseResolvectl},
+	{name: "resolv.conf", cmd: "cat /etc/resolv.conf", parse: parseResolvConf},
+	{name: "scutil", cmd: "scutil --dns", parse: parseScutil},
+}
+
+// remoteDNS returns the nameservers the server resolves with, the first source
+// that works wins.
+func remoteDNS(cli *ssh.Client) []string {
+	for _, source := range resolverSources {
+		servers, err := runResolverSource(cli, source)
+		if err != nil {
+			log.Debug().Str("source", source.name).Err(err).Msg("SSH", "skip dns source")
+
+			continue
+		}
+
+		if len(servers) != 0 {
+			log.Debug().Str("source", source.name).Str("dns", strings.Join(servers, ",")).Msg("SSH", "found dns servers")
+
+			return servers
+		}
+	}
+
+	log.Warn().Str("dns", fallbackDNS).Msg("SSH", "no dns servers found, using the resolver of the server")
+
+	return []string{fallbackDNS}
+}
+
+func runResolverSource(cli *ssh.Client, source resolverSource) ([]string, error) {
+	session, err := cli.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	out, err := session.Output(source.cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return source.parse(out), nil
+}
+
+// parseResolvectl reads "Global: 10.0.0.2" and "Link 2 (eth0): 10.0.0.2#dns.example.com" lines.
+func parseResolvectl(out []byte) []string {
+	var servers []string
+
+	scanLines(out, func(line string) {
+		_, list, ok := strings.Cut(line, ": ")
+		if !ok {
+			return
+		}
+
+		for _, field := range strings.Fields(list) {
+			field, _, _ = strings.Cut(field, "#")
+			servers = appendServer(servers, field)
+		}
+	})
+
+	return servers
+}
+
+// parseResolvConf reads "nameserver 10.0.0.2" lines.
+func parseResolvConf(out []byte) []string {
+	var servers []string
+
+	scanLines(out, func(line string) {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = appendServer(servers, fields[1])
+		}
+	})
+
+	return servers
+}
+
+// parseScutil reads "nameserver[0] : 10.0.0.2" lines.
+func parseScutil(out []byte) []string {
+	var servers []string
+
+	scanLines(out, func(line string) {
+		key, value, ok := strings.Cut(line, " : ")
+		if ok && strings.HasPrefix(strings.TrimSpace(key), "nameserver[") {
+			servers = appendServer(servers, strings.TrimSpace(value))
+		}
+	})
+
+	return servers
+}
+
+func scanLines(out []byte, fn func(line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		fn(strings.TrimSpace(scanner.Text()))
+	}
+}
+
+// appendServer adds a valid address that is not listed yet, zones of link-local
+// addresses mean nothing on this side of the tunnel and are dropped.
+func appendServer(servers []string, s string) []string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return servers
+	}
+
+	s = addr.WithZone("").String()
+
+	for _, server := range servers {
+		if server == s {
+			return servers
+		}
+	}
+
+	return append(servers, s)
+}
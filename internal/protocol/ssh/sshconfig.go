@@ -0,0 +1,367 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+const (
+	sshConfigFile   = "~/.ssh/config"
+	maxIncludeDepth = 16
+)
+
+var errIncludeDepth = errors.New("ssh config include nested too deep")
+
+// applySSHConfig returns cfg with the options it leaves empty taken from the
+// OpenSSH config of its alias.
+func applySSHConfig(cfg *Config) (*Config, error) {
+	if cfg.Alias == "" {
+		return cfg, nil
+	}
+
+	path := sshConfigFile
+	if cfg.SSHConfig != "" {
+		path = cfg.SSHConfig
+	}
+
+	sc, err := lookupSSHConfig(path, cfg.Alias, cfg.User)
+	if err != nil {
+		return nil, fmt.Errorf("ssh config %s: %w", path, err)
+	}
+
+	c := *cfg
+
+	setDefault(&c.Host, sc.host)
+	setDefault(&c.User, sc.user)
+	if c.IdentityFile == "" {
+		c.IdentityFile = sc.get("identityfile")
+		c.identityOptional = c.IdentityFile != ""
+	}
+
+	if c.Certificate == "" {
+		c.Certificate = sc.get("certificatefile")
+		c.certificateOptional = c.Certificate != ""
+	}
+
+	setDefault(&c.KnownHosts, sc.get("userknownhostsfile"))
+
+	if agent := sc.get("identityagent"); agent != "none" && agent != "SSH_AUTH_SOCK" {
+		setDefault(&c.AgentSocket, agent)
+	}
+
+	if len(c.Jump) == 0 {
+		c.Jump, err = parseProxyJump(sc.get("proxyjump"), path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Port == 0 && sc.get("port") != "" {
+		c.Port, err = strconv.Atoi(sc.get("port"))
+		if err != nil {
+			return nil, fmt.Errorf("ssh config %s: port of %s: %w", path, cfg.Alias, err)
+		}
+	}
+
+	log.Debug().Str("alias", cfg.Alias).Str("host", c.Host).Str("port", strconv.Itoa(c.Port)).Msg("SSH", "resolve ssh config")
+
+	return &c, nil
+}
+
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// sshConfig holds the options of ~/.ssh/config that apply to a host, the first
+// obtained value of every keyword wins like in OpenSSH.
+type sshConfig struct {
+	alias  string
+	host   string
+	user   string
+	home   string
+	local  string
+	values map[string][]string
+}
+
+// lookupSSHConfig reads the options of alias from the OpenSSH config at path.
+func lookupSSHConfig(path, alias, remoteUser string) (*sshConfig, error) {
+	c := &sshConfig{
+		alias:  alias,
+		host:   alias,
+		user:   remoteUser,
+		values: make(map[string][]string),
+	}
+
+	if usr, err := invokingUser(); err == nil {
+		c.home = usr.HomeDir
+		c.local = usr.Username
+	} else if usr, err := user.Current(); err == nil {
+		c.home = usr.HomeDir
+		c.local = usr.Username
+	}
+
+	if err := c.read(expandPath(path), 0); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// get returns the first argument of keyword with the tokens of OpenSSH expanded.
+func (c *sshConfig) get(keyword string) string {
+	args, ok := c.values[keyword]
+	if !ok {
+		return ""
+	}
+
+	return c.expand(args[0])
+}
+
+func (c *sshConfig) read(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%w: %s", errIncludeDepth, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if depth > 0 && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer file.Close()
+
+	active := true
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args := splitConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			active = matchPatterns(c.alias, args)
+		case "match":
+			active = c.match(args)
+		case "include":
+			if !active {
+				continue
+			}
+
+			for _, pattern := range args {
+				if err := c.include(pattern, depth); err != nil {
+					return fmt.Errorf("%s:%d: %w", path, line, err)
+				}
+			}
+		default:
+			if !active || len(args) == 0 {
+				continue
+			}
+
+			if _, ok := c.values[keyword]; ok {
+				continue
+			}
+
+			c.values[keyword] = args
+
+			switch keyword {
+			case "hostname":
+				c.host = c.expand(args[0])
+			case "user":
+				if c.user == "" {
+					c.user = args[0]
+				}
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (c *sshConfig) include(pattern string, depth int) error {
+	pattern = c.expand(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(c.home, ".ssh", pattern)
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := c.read(file, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// match evaluates the criteria of a Match line, criteria warp can not evaluate never match.
+func (c *sshConfig) match(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var matched bool
+
+		switch criterion {
+		case "all", "final":
+			matched = true
+		case "canonical":
+			matched = false
+		case "host", "originalhost", "user", "localuser":
+			if i+1 >= len(args) {
+				return false
+			}
+
+			i++
+
+			value := map[string]string{
+				"host":         c.host,
+				"originalhost": c.alias,
+				"user":         c.user,
+				"localuser":    c.local,
+			}[criterion]
+
+			matched = matchPatterns(value, strings.Split(args[i], ","))
+		default:
+			log.Debug().Str("criterion", criterion).Msg("SSH", "unsupported ssh config match")
+
+			return false
+		}
+
+		if matched == negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// expand replaces the tokens of OpenSSH that make sense without a connection.
+func (c *sshConfig) expand(value string) string {
+	if strings.HasPrefix(value, "~/") {
+		value = c.home + value[1:]
+	}
+
+	return strings.NewReplacer(
+		"%%", "%",
+		"%h", c.host,
+		"%n", c.alias,
+		"%r", c.user,
+		"%u", c.local,
+		"%d", c.home,
+	).Replace(value)
+}
+
+// splitConfigLine returns the lower-cased keyword and the arguments of a config line.
+func splitConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+
+	var (
+		fields  []string
+		current strings.Builder
+		quoted  bool
+		equals  bool
+	)
+
+	for _, r := range line {
+		// A single = separates the keyword from the arguments, with or without spaces.
+		separator := r == '=' && !equals && (len(fields) == 0 || (len(fields) == 1 && current.Len() == 0))
+
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || separator):
+			equals = equals || separator
+
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return strings.ToLower(fields[0]), fields[1:]
+}
+
+// matchPatterns reports whether value matches a pattern and no negated pattern.
+func matchPatterns(value string, patterns []string) bool {
+	var matched bool
+
+	for _, pattern := range patterns {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			if wildcardMatch(strings.ToLower(negated), strings.ToLower(value)) {
+				return false
+			}
+
+			continue
+		}
+
+		if wildcardMatch(strings.ToLower(pattern), strings.ToLower(value)) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// wildcardMatch matches s against pattern with the * and ? wildcards.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+
+	return len(s) == 0
+}
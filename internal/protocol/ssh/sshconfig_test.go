@@ -0,0 +1,214 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLookupSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, dir, "corp.conf", `
+Host *.corp
+  User deploy
+  IdentityFile `+dir+`/%n_%r
+`)
+
+	path := writeFile(t, dir, "config", `
+# Comments and blank lines are skipped.
+
+Host bastion
+  HostName bastion.example.com
+  Port=2222
+  User admin
+  ProxyJump none
+
+Host db-? !db-9
+  HostName %n.internal
+  ProxyJump jump@bastion:2222
+
+Host "web server" web
+  HostName web.example.com
+  IdentityFile "~/keys/web key"
+
+Match host db-*.internal user admin
+  IdentityFile ~/.ssh/db_admin
+
+Match originalhost db-1 !user admin
+  IdentityFile ~/.ssh/db_other
+
+Match exec "true"
+  User nobody
+
+Host *
+Include `+dir+`/*.conf
+Include `+dir+`/missing/*.conf
+
+Host *
+  User fallback
+  Port 22
+  CertificateFile %d/certs/%h-%%
+`)
+
+	tests := []struct {
+		alias  string
+		user   string
+		host   string
+		values map[string]string
+	}{
+		{
+			alias: "bastion",
+			host:  "bastion.example.com",
+			values: map[string]string{
+				"user":      "admin",
+				"port":      "2222",
+				"proxyjump": "none",
+			},
+		},
+		{
+			alias: "db-1",
+			user:  "admin",
+			host:  "db-1.internal",
+			values: map[string]string{
+				"user":            "fallback",
+				"port":            "22",
+				"proxyjump":       "jump@bastion:2222",
+				"identityfile":    "~/.ssh/db_admin",
+				"certificatefile": "~/certs/db-1.internal-%",
+			},
+		},
+		{
+			alias: "db-1",
+			host:  "db-1.internal",
+			values: map[string]string{
+				"user":         "fallback",
+				"identityfile": "~/.ssh/db_other",
+			},
+		},
+		{
+			alias: "db-9",
+			host:  "db-9",
+			values: map[string]string{
+				"user":         "fallback",
+				"proxyjump":    "",
+				"identityfile": "",
+			},
+		},
+		{
+			alias: "web",
+			host:  "web.example.com",
+			values: map[string]string{
+				"identityfile": "~/keys/web key",
+			},
+		},
+		{
+			alias: "app.corp",
+			host:  "app.corp",
+			values: map[string]string{
+				"user":         "deploy",
+				"identityfile": dir + "/app.corp_deploy",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		sc, err := lookupSSHConfig(path, tt.alias, tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sc.host != tt.host {
+			t.Errorf("%s: host %q, want %q", tt.alias, sc.host, tt.host)
+		}
+
+		for keyword, want := range tt.values {
+			want = strings.Replace(want, "~", sc.home, 1)
+
+			if got := sc.get(keyword); got != want {
+				t.Errorf("%s as %q: %s %q, want %q", tt.alias, tt.user, keyword, got, want)
+			}
+		}
+	}
+}
+
+func TestLookupSSHConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	loop := writeFile(t, dir, "loop", "Include "+filepath.Join(dir, "loop")+"\n")
+
+	if _, err := lookupSSHConfig(loop, "host", ""); !errors.Is(err, errIncludeDepth) {
+		t.Fatalf("include loop: got %v", err)
+	}
+
+	if _, err := lookupSSHConfig(filepath.Join(dir, "missing"), "host", ""); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing config: got %v", err)
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		value    string
+		patterns string
+		want     bool
+	}{
+		{"db-1", "db-?", true},
+		{"db-10", "db-?", false},
+		{"db-10", "db-*", true},
+		{"DB-1", "db-1", true},
+		{"db-9", "db-* !db-9", false},
+		{"db-9", "!db-9 db-*", false},
+		{"db-1", "!db-9", false},
+		{"a.corp", "*.corp,*.example", true},
+		{"", "*", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchPatterns(tt.value, strings.FieldsFunc(tt.patterns, func(r rune) bool {
+			return r == ' ' || r == ','
+		})); got != tt.want {
+			t.Errorf("%q against %q: got %v, want %v", tt.value, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		keyword string
+		args    string
+	}{
+		{"  HostName example.com  ", "hostname", "example.com"},
+		{"Port=22", "port", "22"},
+		{"Port = 22", "port", "22"},
+		{"Port= 22", "port", "22"},
+		{"SetEnv A==b", "setenv", "A==b"},
+		{"IdentityFile \"~/my key\"", "identityfile", "~/my key"},
+		{"LocalCommand echo a=b", "localcommand", "echo|a=b"},
+		{"\tHost\ta b", "host", "a|b"},
+		{"# Host a", "", ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		keyword, args := splitConfigLine(tt.line)
+
+		if keyword != tt.keyword || strings.Join(args, "|") != tt.args {
+			t.Errorf("%q: got %q %q, want %q %q", tt.line, keyword, args, tt.keyword, tt.args)
+		}
+	}
+}
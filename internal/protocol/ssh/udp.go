@@ -0,0 +1,301 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+// Frames between warp and the relay helper are a big-endian header of flow id,
+// frame type and payload length followed by the payload, see udp_helper.py.
+const (
+	frameOpen  = 0 // payload "<ip> <port>", warp to helper only
+	frameData  = 1
+	frameClose = 2
+
+	frameHeaderSize = 7
+	maxDatagram     = 65535
+)
+
+var (
+	defaultUDPHelper  = "python3"
+	defaultUDPTimeout = time.Minute
+	errRelayClosed    = errors.New("udp relay closed")
+)
+
+// udpHelperScript keeps a NAT table of connected UDP sockets by flow id on the
+// server, udp_helper.py describes the framing in detail.
+//
+//go:embed udp_helper.py
+var udpHelperScript string
+
+// udpRelay forwards the UDP flows of the tunnel through a single helper process
+// started in an ssh session on the server.
+type udpRelay struct {
+	p       *Protocol
+	helper  string
+	timeout time.Duration
+	session *udpSession
+	next    uint32
+	mx      sync.Mutex
+}
+
+type udpSession struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	flows   map[uint32]*udpFlow
+	closed  bool
+	wmx     sync.Mutex
+	mx      sync.Mutex
+}
+
+type udpFlow struct {
+	conn   net.Conn
+	active atomic.Int64
+}
+
+func newUDPRelay(p *Protocol, cfg *Config) *udpRelay {
+	r := &udpRelay{
+		p:       p,
+		helper:  defaultUDPHelper,
+		timeout: defaultUDPTimeout,
+	}
+
+	setDefault(&r.helper, cfg.UDPHelper)
+
+	if cfg.UDPTimeout > 0 {
+		r.timeout = cfg.UDPTimeout
+	}
+
+	return r
+}
+
+// handle relays the datagrams of conn until it is idle for the timeout.
+func (r *udpRelay) handle(conn net.Conn) error {
+	addr, err := net.ResolveUDPAddr("udp", conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+
+	s, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	flow := &udpFlow{conn: conn}
+	flow.active.Store(time.Now().UnixNano())
+
+	id := r.register(s, flow)
+	defer s.release(id)
+
+	defer network.Track("SSH", conn)()
+
+	if err := s.write(id, frameOpen, []byte(addr.IP.String()+" "+strconv.Itoa(addr.Port))); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxDatagram)
+
+	for {
+		_ = conn.SetReadDeadline(time.Unix(0, flow.active.Load()).Add(r.timeout))
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, flow.active.Load())) < r.timeout {
+				continue
+			}
+
+			return nil
+		}
+
+		flow.active.Store(time.Now().UnixNano())
+
+		if err := s.write(id, frameData, buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *udpRelay) register(s *udpSession, flow *udpFlow) uint32 {
+	r.mx.Lock()
+	r.next++
+	id := r.next
+	r.mx.Unlock()
+
+	s.mx.Lock()
+	s.flows[id] = flow
+	s.mx.Unlock()
+
+	return id
+}
+
+// open returns the running helper session, starting one on the current connection.
+func (r *udpRelay) open() (*udpSession, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.session != nil && !r.session.isClosed() {
+		return r.session, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reconnectWait)
+	defer cancel()
+
+	cli, err := r.p.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := cli.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
+
+		return nil, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		_ = session.Close()
+
+		return nil, err
+	}
+
+	// The script travels base64 encoded so no quoting of the remote shell applies.
+	script := base64.StdEncoding.EncodeToString([]byte(udpHelperScript))
+	cmd := fmt.Sprintf("%s -c \"import base64;exec(base64.b64decode('%s'))\" %g", r.helper, script, r.timeout.Seconds())
+
+	if err := session.Start(cmd); err != nil {
+		_ = session.Close()
+
+		return nil, fmt.Errorf("start udp relay: %w", err)
+	}
+
+	log.Debug().Str("url", r.p.target().String()).Msg("SSH", "udp relay started")
+
+	r.session = &udpSession{
+		session: session,
+		stdin:   stdin,
+		flows:   make(map[uint32]*udpFlow),
+	}
+
+	go r.session.read(stdout)
+
+	return r.session, nil
+}
+
+// read delivers the datagrams of the helper to their flows until the session ends.
+func (s *udpSession) read(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	header := make([]byte, frameHeaderSize)
+
+	var err error
+
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			break
+		}
+
+		id := binary.BigEndian.Uint32(header)
+
+		s.mx.Lock()
+		flow := s.flows[id]
+		s.mx.Unlock()
+
+		if flow == nil {
+			continue
+		}
+
+		switch header[4] {
+		case frameData:
+			flow.active.Store(time.Now().UnixNano())
+
+			_, _ = flow.conn.Write(payload)
+		case frameClose:
+			_ = flow.conn.Close()
+		}
+	}
+
+	if waitErr := s.session.Wait(); waitErr != nil {
+		err = waitErr
+	}
+
+	log.Warn().Err(err).Msg("SSH", "udp relay stopped")
+
+	s.close()
+}
+
+func (s *udpSession) write(id uint32, kind byte, payload []byte) error {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = kind
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+
+	if s.isClosed() {
+		return errRelayClosed
+	}
+
+	_, err := s.stdin.Write(frame)
+
+	return err
+}
+
+// release forgets the flow and closes its socket on the server.
+func (s *udpSession) release(id uint32) {
+	s.mx.Lock()
+	delete(s.flows, id)
+	s.mx.Unlock()
+
+	_ = s.write(id, frameClose, nil)
+}
+
+func (s *udpSession) isClosed() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.closed
+}
+
+// close ends the flows of the session, new flows start another helper.
+func (s *udpSession) close() {
+	s.mx.Lock()
+	s.closed = true
+	flows := s.flows
+	s.flows = make(map[uint32]*udpFlow)
+	s.mx.Unlock()
+
+	_ = s.session.Close()
+
+	for _, flow := range flows {
+		_ = flow.conn.Close()
+	}
+}
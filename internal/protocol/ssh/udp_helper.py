@@ -0,0 +1,119 @@
+# UDP relay helper, started by warp in an ssh session on the server.
+#
+# warp multiplexes the UDP flows of the tunnel over stdin and stdout of this
+# process. Every frame is a 7 byte big-endian header followed by the payload:
+#
+#   flow id  uint32  chosen by warp, unique within the session
+#   type     uint8   0 open, 1 data, 2 close
+#   length   uint16  payload length
+#
+# open   warp to helper: payload "<ip> <port>", connects a new UDP socket
+# data   both ways: one datagram of the flow
+# close  both ways: the flow is over, sent by the helper when the socket
+#        failed to connect or was idle for longer than the timeout
+#
+# The only argument is the idle timeout in seconds.
+
+import os
+import select
+import socket
+import struct
+import sys
+import time
+
+HEADER = struct.Struct(">IBH")
+FRAME_OPEN, FRAME_DATA, FRAME_CLOSE = 0, 1, 2
+MAX_DATAGRAM = 65535
+
+timeout = float(sys.argv[1])
+out = sys.stdout.buffer
+
+sockets = {}  # flow id -> connected UDP socket
+flows = {}  # socket fd -> flow id
+last_active = {}  # flow id -> time of the last datagram
+
+
+def send(flow, kind, payload=b""):
+    out.write(HEADER.pack(flow, kind, len(payload)) + payload)
+    out.flush()
+
+
+def close(flow):
+    sock = sockets.pop(flow, None)
+    last_active.pop(flow, None)
+
+    if sock is not None:
+        flows.pop(sock.fileno(), None)
+        sock.close()
+
+
+def open_flow(flow, payload, now):
+    host, port = payload.decode().rsplit(" ", 1)
+    family = socket.AF_INET6 if ":" in host else socket.AF_INET
+
+    try:
+        sock = socket.socket(family, socket.SOCK_DGRAM)
+        sock.connect((host, int(port)))
+    except OSError:
+        send(flow, FRAME_CLOSE)
+
+        return
+
+    sockets[flow] = sock
+    flows[sock.fileno()] = flow
+    last_active[flow] = now
+
+
+def handle_frame(flow, kind, payload, now):
+    if kind == FRAME_OPEN:
+        open_flow(flow, payload, now)
+    elif kind == FRAME_DATA and flow in sockets:
+        last_active[flow] = now
+
+        try:
+            sockets[flow].send(payload)
+        except OSError:
+            pass
+    elif kind == FRAME_CLOSE:
+        close(flow)
+
+
+def main():
+    pending = b""
+
+    while True:
+        readable = select.select([0] + list(flows), [], [], 1)[0]
+        now = time.time()
+
+        for fd in readable:
+            if fd == 0:
+                data = os.read(0, 65536)
+                if not data:
+                    return
+
+                pending += data
+
+                while len(pending) >= HEADER.size:
+                    flow, kind, length = HEADER.unpack_from(pending)
+                    if len(pending) < HEADER.size + length:
+                        break
+
+                    payload = pending[HEADER.size:HEADER.size + length]
+                    pending = pending[HEADER.size + length:]
+
+                    handle_frame(flow, kind, payload, now)
+            elif fd in flows:
+                flow = flows[fd]
+
+                try:
+                    send(flow, FRAME_DATA, sockets[flow].recv(MAX_DATAGRAM))
+                    last_active[flow] = now
+                except OSError:
+                    pass
+
+        for flow in [f for f, t in last_active.items() if now - t > timeout]:
+            close(flow)
+            send(flow, FRAME_CLOSE)
+
+
+main()
@@ -0,0 +1,186 @@
+package wg
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	wgconn "golang.zx2c4.com/wireguard/conn"
+
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+var bindDialTimeout = 5 * time.Second
+
+// dialBind carries the tunnel over udp connections opened with dial, for
+// example through another protocol. The connection to the peer is dialed on
+// the first send and again after it fails.
+type dialBind struct {
+	dial network.DialFunc
+	conn net.Conn
+	ep   wgconn.Endpoint
+	wake chan struct{}
+	done chan struct{}
+	mx   sync.Mutex
+}
+
+func newDialBind(dial network.DialFunc) *dialBind {
+	return &dialBind{dial: dial}
+}
+
+func (b *dialBind) Open(port uint16) ([]wgconn.ReceiveFunc, uint16, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.done != nil {
+		return nil, 0, wgconn.ErrBindAlreadyOpen
+	}
+
+	b.wake = make(chan struct{})
+	b.done = make(chan struct{})
+
+	return []wgconn.ReceiveFunc{b.receive}, port, nil
+}
+
+func (b *dialBind) Close() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.done == nil {
+		return nil
+	}
+
+	close(b.done)
+	b.done = nil
+
+	if b.conn != nil {
+		_ = b.conn.Close()
+		b.conn = nil
+	}
+
+	return nil
+}
+
+func (b *dialBind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *dialBind) BatchSize() int {
+	return 1
+}
+
+func (b *dialBind) ParseEndpoint(s string) (wgconn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wgconn.StdNetEndpoint{AddrPort: addr}, nil
+}
+
+func (b *dialBind) Send(bufs [][]byte, ep wgconn.Endpoint) error {
+	conn, err := b.connect(ep)
+	if err != nil {
+		return err
+	}
+
+	for _, buf := range bufs {
+		if _, err := conn.Write(buf); err != nil {
+			b.drop(conn)
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receive reads the next packet from the peer, it waits while there is no connection.
+func (b *dialBind) receive(packets [][]byte, sizes []int, eps []wgconn.Endpoint) (int, error) {
+	b.mx.Lock()
+	conn, ep, wake, done := b.conn, b.ep, b.wake, b.done
+	b.mx.Unlock()
+
+	if done == nil {
+		return 0, net.ErrClosed
+	}
+
+	if conn == nil {
+		select {
+		case <-wake:
+			return 0, nil
+		case <-done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n, err := conn.Read(packets[0])
+	if err != nil {
+		b.drop(conn)
+
+		return 0, nil
+	}
+
+	sizes[0] = n
+	eps[0] = ep
+
+	return 1, nil
+}
+
+// connect returns the connection to ep, dialing it if there is none yet.
+func (b *dialBind) connect(ep wgconn.Endpoint) (net.Conn, error) {
+	b.mx.Lock()
+	conn := b.conn
+	if conn != nil && b.ep.DstToString() != ep.DstToString() {
+		_ = conn.Close()
+		b.conn, conn = nil, nil
+	}
+	b.mx.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bindDialTimeout)
+	defer cancel()
+
+	conn, err := b.dial(ctx, "udp", ep.DstToString())
+	if err != nil {
+		return nil, err
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.done == nil {
+		_ = conn.Close()
+
+		return nil, net.ErrClosed
+	}
+
+	// A concurrent send dialed first.
+	if b.conn != nil {
+		_ = conn.Close()
+
+		return b.conn, nil
+	}
+
+	b.conn, b.ep = conn, ep
+
+	close(b.wake)
+	b.wake = make(chan struct{})
+
+	return conn, nil
+}
+
+func (b *dialBind) drop(conn net.Conn) {
+	b.mx.Lock()
+	if b.conn == conn {
+		b.conn = nil
+	}
+	b.mx.Unlock()
+
+	_ = conn.Close()
+}
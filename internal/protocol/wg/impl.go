@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 
 	"github.com/MakeNowJust/heredoc"
 	"github.com/miekg/dns"
@@ -20,30 +21,42 @@ import (
 
 	"github.com/merzzzl/warp/internal/utils/log"
 	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/upstream"
 )
 
-var errKeyInvalid = errors.New("invalid wireguard key")
+var (
+	errKeyInvalid = errors.New("invalid wireguard key")
+	errNoAddress  = errors.New("wireguard address is required")
+)
 
 type Config struct {
-	PrivateKey    string   `yaml:"private_key"`
-	PeerPublicKey string   `yaml:"peer_public_key"`
-	Endpoint      string   `yaml:"endpoint"`
-	Domains       []string `yaml:"domains"`
-	Address       string   `yaml:"address"`
-	DNS           []string `yaml:"dns"`
-	IPs           []string `yaml:"ips"`
+	PrivateKey    string    `yaml:"private_key"`
+	PeerPublicKey string    `yaml:"peer_public_key"`
+	Endpoint      string    `yaml:"endpoint"`
+	Domains       []string  `yaml:"domains"`
+	Address       Addresses `yaml:"address"`
+	DNS           []string  `yaml:"dns"`
+	IPs           []string  `yaml:"ips"`
+	IPv6          *bool     `yaml:"ipv6"`
 }
 
+// Addresses is a list of interface addresses. In YAML it is either a list or
+// a single comma separated string, each address optionally in CIDR notation.
+type Addresses []netip.Addr
+
 type Protocol struct {
 	tnet    *netstack.Net
 	domains []string
-	dns     []string
+	dns     []*upstream.Upstream
 	ips     []string
+	ipv6    bool
 }
 
 var defaultMTU = 1480
 
-func New(ctx context.Context, cfg *Config) (*Protocol, error) {
+// New brings the tunnel up, dial carries it over udp and the host network is
+// used directly if nil.
+func New(ctx context.Context, cfg *Config, dial network.DialFunc) (*Protocol, error) {
 	var request bytes.Buffer
 
 	privateKey, err := encodeBase64ToHex(cfg.PrivateKey)
@@ -71,25 +84,34 @@ func New(ctx context.Context, cfg *Config) (*Protocol, error) {
 		return nil, err
 	}
 
-	localAddress, err := netip.ParseAddr(cfg.Address)
+	if len(cfg.Address) == 0 {
+		return nil, errNoAddress
+	}
+
+	localAddress := strings.Join(cfg.Address.Strings(), ",")
+
+	p := &Protocol{
+		domains: cfg.Domains,
+		ips:     cfg.IPs,
+		ipv6:    cfg.IPv6 != nil && *cfg.IPv6,
+	}
+
+	p.dns, err = upstream.NewList(cfg.DNS, "udp", p.DialContext)
 	if err != nil {
 		return nil, err
 	}
 
-	dnss := make([]netip.Addr, 0, len(cfg.DNS))
+	dnss := make([]netip.Addr, 0, len(p.dns))
 
-	for i := range cfg.DNS {
-		addr, err := netip.ParseAddr(cfg.DNS[i])
-		if err != nil {
-			return nil, err
+	for _, up := range p.dns {
+		if addr, ok := up.Addr(); ok {
+			dnss = append(dnss, addr)
 		}
-
-		dnss = append(dnss, addr)
 	}
 
-	log.Debug().Str("ip", localAddress.String()).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "create tun")
+	log.Debug().Str("ip", localAddress).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "create tun")
 
-	tun, tnet, err := netstack.CreateNetTUN([]netip.Addr{localAddress}, dnss, defaultMTU)
+	tun, tnet, err := netstack.CreateNetTUN(cfg.Address, dnss, defaultMTU)
 	if err != nil {
 		return nil, err
 	}
@@ -103,16 +125,21 @@ func New(ctx context.Context, cfg *Config) (*Protocol, error) {
 		},
 	}
 
-	log.Debug().Str("ip", localAddress.String()).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "create device")
+	log.Debug().Str("ip", localAddress).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "create device")
+
+	bind := wgconn.NewDefaultBind()
+	if dial != nil {
+		bind = newDialBind(dial)
+	}
 
-	dev := device.NewDevice(tun, wgconn.NewDefaultBind(), &wglog)
+	dev := device.NewDevice(tun, bind, &wglog)
 
 	err = dev.IpcSet(request.String())
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debug().Str("ip", localAddress.String()).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "up device")
+	log.Debug().Str("ip", localAddress).Str("mtu", strconv.Itoa(defaultMTU)).Msg("WRG", "up device")
 
 	err = dev.Up()
 	if err != nil {
@@ -125,12 +152,68 @@ func New(ctx context.Context, cfg *Config) (*Protocol, error) {
 		dev.Close()
 	}()
 
-	return &Protocol{
-		domains: cfg.Domains,
-		tnet:    tnet,
-		dns:     cfg.DNS,
-		ips:     cfg.IPs,
-	}, nil
+	p.tnet = tnet
+
+	return p, nil
+}
+
+// DialContext opens a connection to addr inside the tunnel.
+func (p *Protocol) DialContext(ctx context.Context, n, addr string) (net.Conn, error) {
+	return p.tnet.DialContext(ctx, n, addr)
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (a *Addresses) UnmarshalYAML(unmarshal func(any) error) error {
+	var list []string
+
+	if err := unmarshal(&list); err != nil {
+		var str string
+
+		if err := unmarshal(&str); err != nil {
+			return err
+		}
+
+		list = strings.Split(str, ",")
+	}
+
+	addrs := make(Addresses, 0, len(list))
+
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return err
+			}
+
+			addrs = append(addrs, prefix.Addr())
+
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return err
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	*a = addrs
+
+	return nil
+}
+
+// Strings returns the addresses in text form.
+func (a Addresses) Strings() []string {
+	list := make([]string, 0, len(a))
+
+	for _, addr := range a {
+		list = append(list, addr.String())
+	}
+
+	return list
 }
 
 func encodeBase64ToHex(key string) (string, error) {
@@ -154,42 +237,19 @@ func (p *Protocol) FixedIPs() []string {
 	return p.ips
 }
 
-func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) *dns.Msg {
-	for _, addr := range p.dns {
-		dial, err := p.tnet.DialContext(ctx, "udp", addr+":53")
-		if err != nil {
-			log.Error().Err(err).DNS(req).Msg("WRG", "failed to handle dns req")
-
-			continue
-		}
-
-		co := new(dns.Conn)
-		co.Conn = dial
-
-		err = co.WriteMsg(req)
-		if err != nil {
-			log.Error().Err(err).DNS(req).Msg("WRG", "failed to handle dns req")
-
-			continue
-		}
-
-		rsp, err := co.ReadMsg()
-		if err != nil {
-			log.Error().Err(err).DNS(req).Msg("WRG", "failed to handle dns req")
-
-			continue
-		}
-
-		log.Debug().Str("server", addr).DNS(req).Msg("WRG", "handle dns req")
-
-		if len(rsp.Answer) == 0 {
-			continue
-		}
+func (p *Protocol) IPv6() bool {
+	return p.ipv6
+}
 
-		return rsp
+func (p *Protocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	rsp, err := upstream.Exchange(ctx, p.dns, req)
+	if err != nil {
+		return nil, err
 	}
 
-	return req
+	log.Debug().DNS(req).Msg("WRG", "handle dns req")
+
+	return rsp, nil
 }
 
 func (p *Protocol) HandleTCP(conn net.Conn) {
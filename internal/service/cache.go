@@ -0,0 +1,278 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+)
+
+// DNSCache keeps protocol answers for their TTL, negative answers are kept
+// for the SOA minimum (RFC 2308) and expired entries are served stale while
+// they are refreshed in the background (RFC 8767).
+type DNSCache struct {
+	entries    map[cacheKey]*cacheEntry
+	refreshing map[cacheKey]struct{}
+	size       int
+	stale      time.Duration
+	now        func() time.Time
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+	mutex      sync.Mutex
+}
+
+type cacheKey struct {
+	protocol Protocol
+	name     string
+	qtype    uint16
+	qclass   uint16
+}
+
+type cacheEntry struct {
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+type lookupFunc func(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+
+var (
+	defaultDNSCacheSize = 4096
+	defaultDNSStale     = time.Hour
+	staleTTL            = uint32(30)
+	refreshTimeout      = 10 * time.Second
+)
+
+func newDNSCache(size int, stale time.Duration) *DNSCache {
+	if size == 0 {
+		size = defaultDNSCacheSize
+	}
+
+	if stale == 0 {
+		stale = defaultDNSStale
+	}
+
+	return &DNSCache{
+		entries:    make(map[cacheKey]*cacheEntry),
+		refreshing: make(map[cacheKey]struct{}),
+		size:       size,
+		stale:      max(stale, 0),
+		now:        time.Now,
+	}
+}
+
+// Stats returns the number of cache hits and misses.
+func (c *DNSCache) Stats() (uint64, uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// lookup answers req from the cache or with resolve of the given protocol,
+// answers the protocol asks not to cache always come from resolve.
+func (c *DNSCache) lookup(ctx context.Context, protocol Protocol, req *dns.Msg, resolve lookupFunc) (*dns.Msg, error) {
+	if c.size < 0 || len(req.Question) != 1 {
+		return resolve(ctx, req)
+	}
+
+	if p, ok := protocol.(protocolNoCache); ok && p.NoCache(req) {
+		return resolve(ctx, req)
+	}
+
+	q := req.Question[0]
+	key := cacheKey{
+		protocol: protocol,
+		name:     strings.ToLower(q.Name),
+		qtype:    q.Qtype,
+		qclass:   q.Qclass,
+	}
+
+	now := c.now()
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	c.mutex.Unlock()
+
+	if ok && now.Before(entry.expire) {
+		c.hits.Add(1)
+
+		return entry.reply(req, now), nil
+	}
+
+	if ok && now.Before(entry.expire.Add(c.stale)) {
+		c.hits.Add(1)
+
+		if c.claim(key) {
+			go c.refresh(context.WithoutCancel(ctx), key, req.Copy(), resolve)
+		}
+
+		return entry.staleReply(req), nil
+	}
+
+	c.misses.Add(1)
+
+	rsp, err := resolve(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.store(key, rsp, now)
+
+	return rsp, nil
+}
+
+// claim reports whether the caller is the one to refresh key, the claim is
+// taken before the refresh goroutine starts so stale hits never start two.
+func (c *DNSCache) claim(key cacheKey) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.refreshing[key]; ok {
+		return false
+	}
+
+	c.refreshing[key] = struct{}{}
+
+	return true
+}
+
+// refresh resolves req again for key claimed with claim.
+func (c *DNSCache) refresh(ctx context.Context, key cacheKey, req *dns.Msg, resolve lookupFunc) {
+	defer func() {
+		c.mutex.Lock()
+		delete(c.refreshing, key)
+		c.mutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+
+	rsp, err := resolve(ctx, req)
+	if err != nil {
+		log.Warn().DNS(req).Err(err).Msg("DNS", "refresh cache")
+
+		return
+	}
+
+	c.store(key, rsp, c.now())
+}
+
+func (c *DNSCache) store(key cacheKey, rsp *dns.Msg, now time.Time) {
+	ttl, ok := cacheTTL(rsp)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+
+	c.entries[key] = &cacheEntry{
+		msg:    rsp.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// evict drops entries that can no longer be served, or an arbitrary one if
+// every entry is still fresh.
+func (c *DNSCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expire.Add(c.stale)) {
+			delete(c.entries, key)
+		}
+	}
+
+	if len(c.entries) < c.size {
+		return
+	}
+
+	for key := range c.entries {
+		delete(c.entries, key)
+
+		return
+	}
+}
+
+// cacheTTL returns for how long rsp may be cached.
+func cacheTTL(rsp *dns.Msg) (uint32, bool) {
+	if rsp == nil || !rsp.Response || rsp.Truncated {
+		return 0, false
+	}
+
+	var ttl uint32
+
+	switch {
+	case rsp.Rcode == dns.RcodeSuccess && len(rsp.Answer) != 0:
+		ttl = rsp.Answer[0].Header().Ttl
+
+		for _, rr := range rsp.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	case rsp.Rcode == dns.RcodeSuccess || rsp.Rcode == dns.RcodeNameError:
+		soa := negativeSOA(rsp)
+		if soa == nil {
+			return 0, false
+		}
+
+		ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	default:
+		return 0, false
+	}
+
+	return ttl, ttl != 0
+}
+
+func negativeSOA(rsp *dns.Msg) *dns.SOA {
+	for _, rr := range rsp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+
+	return nil
+}
+
+// reply returns the cached answer for req with the TTLs reduced by its age.
+func (e *cacheEntry) reply(req *dns.Msg, now time.Time) *dns.Msg {
+	age := uint32(now.Sub(e.stored) / time.Second)
+
+	return e.answer(req, func(ttl uint32) uint32 {
+		if ttl <= age {
+			return 0
+		}
+
+		return ttl - age
+	})
+}
+
+// staleReply returns the expired answer for req with a short TTL.
+func (e *cacheEntry) staleReply(req *dns.Msg) *dns.Msg {
+	return e.answer(req, func(uint32) uint32 {
+		return staleTTL
+	})
+}
+
+func (e *cacheEntry) answer(req *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	rsp := e.msg.Copy()
+	rsp.Id = req.Id
+	rsp.Question = req.Question
+
+	for _, section := range [][]dns.RR{rsp.Answer, rsp.Ns, rsp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			rr.Header().Ttl = ttl(rr.Header().Ttl)
+		}
+	}
+
+	return rsp
+}
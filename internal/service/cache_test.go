@@ -0,0 +1,289 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingProtocol answers every A query with the next address of a counter.
+type countingProtocol struct {
+	fakeProtocol
+	noCache bool
+	lookups int
+}
+
+func (p *countingProtocol) NoCache(*dns.Msg) bool {
+	return p.noCache
+}
+
+func (p *countingProtocol) LookupHost(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	p.lookups++
+
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+	rsp.Answer = append(rsp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(198, 18, 0, byte(p.lookups)),
+	})
+
+	return rsp, nil
+}
+
+func TestDNSCacheNoCache(t *testing.T) {
+	for _, noCache := range []bool{false, true} {
+		cache := newDNSCache(0, 0)
+		protocol := &countingProtocol{noCache: noCache}
+
+		req := new(dns.Msg)
+		req.SetQuestion("db.corp.example.com.", dns.TypeA)
+
+		var last string
+
+		for i := 0; i < 3; i++ {
+			rsp, err := cache.lookup(context.Background(), protocol, req.Copy(), protocol.LookupHost)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			last = rsp.Answer[0].(*dns.A).A.String()
+		}
+
+		want, wantAddr := 1, "198.18.0.1"
+		if noCache {
+			want, wantAddr = 3, "198.18.0.3"
+		}
+
+		if protocol.lookups != want || last != wantAddr {
+			t.Errorf("no cache %v: %d lookups answered %s, want %d and %s", noCache, protocol.lookups, last, want, wantAddr)
+		}
+	}
+}
+
+// fakeClock moves the clock of cache by hand.
+func fakeClock(cache *DNSCache) func(time.Duration) {
+	start := time.Now()
+
+	var offset atomic.Int64
+
+	cache.now = func() time.Time {
+		return start.Add(time.Duration(offset.Load()))
+	}
+
+	return func(d time.Duration) {
+		offset.Add(int64(d))
+	}
+}
+
+// answerA resolves every query to addr with ttl and counts the lookups.
+func answerA(addr string, ttl uint32, lookups *atomic.Int32) lookupFunc {
+	return func(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+		lookups.Add(1)
+
+		rsp := new(dns.Msg)
+		rsp.SetReply(req)
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(addr),
+		})
+
+		return rsp, nil
+	}
+}
+
+func lookupA(t *testing.T, cache *DNSCache, protocol Protocol, name string, resolve lookupFunc) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+
+	rsp, err := cache.lookup(context.Background(), protocol, req, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rsp
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cache := newDNSCache(0, -1)
+	advance := fakeClock(cache)
+	protocol := &fakeProtocol{name: "p"}
+
+	var lookups atomic.Int32
+
+	resolve := answerA("198.18.0.1", 60, &lookups)
+
+	tests := []struct {
+		after   time.Duration
+		ttl     uint32
+		lookups int32
+	}{
+		{0, 60, 1},
+		{time.Second, 59, 1},
+		{25 * time.Second, 34, 1},
+		{33 * time.Second, 1, 1},
+		{time.Second, 60, 2},
+	}
+
+	for _, tt := range tests {
+		advance(tt.after)
+
+		rsp := lookupA(t, cache, protocol, "DB.example.com.", resolve)
+
+		if ttl := rsp.Answer[0].Header().Ttl; ttl != tt.ttl || lookups.Load() != tt.lookups {
+			t.Fatalf("after %s: ttl %d with %d lookups, want %d with %d", tt.after, ttl, lookups.Load(), tt.ttl, tt.lookups)
+		}
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	tests := []struct {
+		rcode  int
+		ttl    uint32
+		minttl uint32
+		cached time.Duration
+	}{
+		{dns.RcodeNameError, 3600, 30, 30 * time.Second},
+		{dns.RcodeNameError, 10, 300, 10 * time.Second},
+		{dns.RcodeSuccess, 3600, 45, 45 * time.Second},
+		{dns.RcodeNameError, 3600, 0, 0},
+	}
+
+	for _, tt := range tests {
+		cache := newDNSCache(0, -1)
+		advance := fakeClock(cache)
+		protocol := &fakeProtocol{name: "p"}
+
+		var lookups atomic.Int32
+
+		resolve := func(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+			lookups.Add(1)
+
+			rsp := new(dns.Msg)
+			rsp.SetRcode(req, tt.rcode)
+			rsp.Ns = append(rsp.Ns, &dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: tt.ttl},
+				Ns:     "ns.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Minttl: tt.minttl,
+			})
+
+			return rsp, nil
+		}
+
+		lookupA(t, cache, protocol, "missing.example.com.", resolve)
+
+		if tt.cached != 0 {
+			advance(tt.cached - time.Second)
+
+			if rsp := lookupA(t, cache, protocol, "missing.example.com.", resolve); rsp.Rcode != tt.rcode || lookups.Load() != 1 {
+				t.Errorf("soa %d/%d: %d lookups before expiry, want 1", tt.ttl, tt.minttl, lookups.Load())
+			}
+
+			advance(time.Second)
+		}
+
+		lookupA(t, cache, protocol, "missing.example.com.", resolve)
+
+		if lookups.Load() != 2 {
+			t.Errorf("soa %d/%d: %d lookups after %s, want 2", tt.ttl, tt.minttl, lookups.Load(), tt.cached)
+		}
+	}
+}
+
+func TestDNSCacheServeStale(t *testing.T) {
+	cache := newDNSCache(0, time.Hour)
+	advance := fakeClock(cache)
+	protocol := &fakeProtocol{name: "p"}
+
+	var lookups atomic.Int32
+
+	lookupA(t, cache, protocol, "db.example.com.", answerA("198.18.0.1", 60, &lookups))
+	advance(2 * time.Minute)
+
+	gate := make(chan struct{})
+
+	var refreshes atomic.Int32
+
+	refresh := answerA("198.18.0.2", 60, &refreshes)
+	blocked := func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		<-gate
+
+		return refresh(ctx, req)
+	}
+
+	// Expired answers are served stale while a single refresh is running.
+	for i := 0; i < 5; i++ {
+		rsp := lookupA(t, cache, protocol, "db.example.com.", blocked)
+
+		if a := rsp.Answer[0].(*dns.A); a.A.String() != "198.18.0.1" || a.Hdr.Ttl != staleTTL {
+			t.Fatalf("stale answer: %s", a)
+		}
+	}
+
+	close(gate)
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		rsp := lookupA(t, cache, protocol, "db.example.com.", blocked)
+		if rsp.Answer[0].(*dns.A).A.String() == "198.18.0.2" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("cache was not refreshed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if refreshes.Load() != 1 {
+		t.Fatalf("%d refreshes, want 1", refreshes.Load())
+	}
+
+	// Past the stale window the cache waits for the protocol again.
+	advance(2 * time.Hour)
+
+	rsp := lookupA(t, cache, protocol, "db.example.com.", answerA("198.18.0.3", 60, &lookups))
+	if a := rsp.Answer[0].(*dns.A); a.A.String() != "198.18.0.3" || lookups.Load() != 2 {
+		t.Fatalf("after stale window: %s with %d lookups", a, lookups.Load())
+	}
+}
+
+func TestDNSCacheEvict(t *testing.T) {
+	cache := newDNSCache(2, time.Minute)
+	advance := fakeClock(cache)
+	protocol := &fakeProtocol{name: "p"}
+
+	var lookups atomic.Int32
+
+	lookupA(t, cache, protocol, "a.example.com.", answerA("198.18.0.1", 10, &lookups))
+	lookupA(t, cache, protocol, "b.example.com.", answerA("198.18.0.2", 3600, &lookups))
+
+	// a can no longer be served and makes room for c.
+	advance(2 * time.Minute)
+	lookupA(t, cache, protocol, "c.example.com.", answerA("198.18.0.3", 3600, &lookups))
+
+	for _, name := range []string{"b.example.com.", "c.example.com."} {
+		if _, ok := cache.entries[cacheKey{protocol: protocol, name: name, qtype: dns.TypeA, qclass: dns.ClassINET}]; !ok {
+			t.Fatalf("%s was evicted", name)
+		}
+	}
+
+	// Every entry is fresh, one of them goes.
+	lookupA(t, cache, protocol, "d.example.com.", answerA("198.18.0.4", 3600, &lookups))
+
+	if len(cache.entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(cache.entries))
+	}
+
+	if _, ok := cache.entries[cacheKey{protocol: protocol, name: "d.example.com.", qtype: dns.TypeA, qclass: dns.ClassINET}]; !ok {
+		t.Fatal("new entry was not stored")
+	}
+}
@@ -0,0 +1,434 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/upstream"
+)
+
+var (
+	dnsIdleTimeout   = 10 * time.Second
+	dnsLookupTimeout = 5 * time.Second
+)
+
+// handleDNSTCP serves DNS over TCP: every message carries a two byte length
+// prefix and a client may pipeline several queries over one connection, the
+// answers are written as soon as they are ready (RFC 7766).
+func (h *tunTransportHandler) handleDNSTCP(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+		mx sync.Mutex
+	)
+
+	defer conn.Close()
+	defer wg.Wait()
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout)); err != nil {
+			log.Warn().Err(err).Msg("DNS", "read msg")
+
+			return
+		}
+
+		var length uint16
+
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			if !errors.Is(err, io.EOF) && !isTimeout(err) {
+				log.Warn().Err(err).Msg("DNS", "read msg")
+			}
+
+			return
+		}
+
+		b := make([]byte, length)
+
+		if _, err := io.ReadFull(conn, b); err != nil {
+			log.Warn().Err(err).Msg("DNS", "read msg")
+
+			return
+		}
+
+		req := new(dns.Msg)
+
+		if err := req.Unpack(b); err != nil {
+			log.Warn().Err(err).Msg("DNS", "unpack msg")
+
+			return
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			b, err := h.answer(ctx, req, dns.MaxMsgSize).Pack()
+			if err != nil {
+				log.Debug().Err(err).Msg("DNS", "serve dns")
+
+				return
+			}
+
+			msg := binary.BigEndian.AppendUint16(make([]byte, 0, len(b)+2), uint16(len(b)))
+			msg = append(msg, b...)
+
+			mx.Lock()
+			defer mx.Unlock()
+
+			if _, err := conn.Write(msg); err != nil {
+				log.Warn().Err(err).Msg("DNS", "write dns")
+			}
+		}()
+	}
+}
+
+// handleDNSUDP serves DNS over UDP, answers are truncated to the buffer size
+// advertised by the client with EDNS0, or 512 bytes without it.
+func (h *tunTransportHandler) handleDNSUDP(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+		mx sync.Mutex
+	)
+
+	defer conn.Close()
+	defer wg.Wait()
+
+	buf := make([]byte, dns.MaxMsgSize)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(dnsIdleTimeout)); err != nil {
+			log.Warn().Err(err).Msg("DNS", "read msg")
+
+			return
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !isTimeout(err) {
+				log.Warn().Err(err).Msg("DNS", "read msg")
+			}
+
+			return
+		}
+
+		req := new(dns.Msg)
+
+		if err := req.Unpack(buf[:n]); err != nil {
+			log.Warn().Err(err).Msg("DNS", "unpack msg")
+
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			b, err := h.answer(ctx, req, udpSize(req)).Pack()
+			if err != nil {
+				log.Debug().Err(err).Msg("DNS", "serve dns")
+
+				return
+			}
+
+			mx.Lock()
+			defer mx.Unlock()
+
+			if _, err := conn.Write(b); err != nil {
+				log.Warn().Err(err).Msg("DNS", "write dns")
+			}
+		}()
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+
+	return dns.MinMsgSize
+}
+
+// answer resolves every question of req and fits the response into size bytes.
+func (h *tunTransportHandler) answer(ctx context.Context, req *dns.Msg, size int) *dns.Msg {
+	var rsp *dns.Msg
+
+	switch len(req.Question) {
+	case 0:
+		rsp = new(dns.Msg).SetRcode(req, dns.RcodeFormatError)
+	case 1:
+		rsp = h.serveDNS(ctx, req)
+	default:
+		rsp = h.serveQuestions(ctx, req)
+	}
+
+	if rsp == nil {
+		rsp = new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	rsp.Id = req.Id
+	rsp.Extra = withoutOPT(rsp.Extra)
+
+	if opt := req.IsEdns0(); opt != nil {
+		rsp.SetEdns0(uint16(size), opt.Do())
+	}
+
+	rsp.Truncate(size)
+
+	return rsp
+}
+
+// serveQuestions resolves each question of req on its own and merges the answers.
+func (h *tunTransportHandler) serveQuestions(ctx context.Context, req *dns.Msg) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+	rsp.Question = req.Question
+
+	for _, q := range req.Question {
+		sub := req.Copy()
+		sub.Question = []dns.Question{q}
+
+		part := h.serveDNS(ctx, sub)
+		if part == nil {
+			if rsp.Rcode == dns.RcodeSuccess {
+				rsp.Rcode = dns.RcodeServerFailure
+			}
+
+			continue
+		}
+
+		rsp.Answer = append(rsp.Answer, part.Answer...)
+		rsp.Ns = append(rsp.Ns, part.Ns...)
+		rsp.Extra = append(rsp.Extra, withoutOPT(part.Extra)...)
+
+		if rsp.Rcode == dns.RcodeSuccess {
+			rsp.Rcode = part.Rcode
+		}
+	}
+
+	return rsp
+}
+
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	list := rrs[:0:0]
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			list = append(list, rr)
+		}
+	}
+
+	return list
+}
+
+func isIPV6Request(req *dns.Msg) bool {
+	for _, q := range req.Question {
+		if q.Qtype == dns.TypeAAAA {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *tunTransportHandler) protocolIPv6(protocol Protocol) bool {
+	if p, ok := protocol.(protocolIPv6); ok {
+		return p.IPv6()
+	}
+
+	return h.ipv6
+}
+
+func emptyResponse(req *dns.Msg) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+	rsp.Authoritative = true
+	rsp.Rcode = dns.RcodeSuccess
+	return rsp
+}
+
+func errorResponse(req *dns.Msg, rcode int) *dns.Msg {
+	return new(dns.Msg).SetRcode(req, rcode)
+}
+
+// isMiss reports whether rsp says the name has no records of the requested type,
+// so another protocol serving the domain may still know it.
+func isMiss(rsp *dns.Msg) bool {
+	return rsp.Rcode == dns.RcodeNameError || (rsp.Rcode == dns.RcodeSuccess && len(rsp.Answer) == 0)
+}
+
+func (h *tunTransportHandler) serveDNS(ctx context.Context, req *dns.Msg) *dns.Msg {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	if res, ok := h.rules.matchName(req.Question[0].Name); ok {
+		log.Debug().DNS(req).Str("rule", res.name).Msg("DNS", "match rule")
+
+		switch res.action {
+		case actionReject:
+			return errorResponse(req, dns.RcodeNameError)
+		case actionDirect:
+			if !h.ipv6 && isIPV6Request(req) {
+				return emptyResponse(req)
+			}
+
+			return h.serveDirect(ctx, req)
+		}
+
+		rsp, _ := h.resolve(ctx, res.protocol, req)
+
+		return rsp
+	}
+
+	var miss *dns.Msg
+
+	for _, protocol := range h.protocols {
+		var isAllow bool
+
+		for _, domain := range protocol.Domains() {
+			if strings.HasSuffix(req.Question[0].Name, domain+".") {
+				isAllow = true
+			}
+		}
+
+		if !isAllow {
+			continue
+		}
+
+		rsp, isMiss := h.resolve(ctx, protocol, req)
+		if isMiss {
+			miss = rsp
+
+			continue
+		}
+
+		return rsp
+	}
+
+	if miss != nil {
+		return miss
+	}
+
+	if !h.ipv6 && isIPV6Request(req) {
+		log.Debug().Msg("DNS", "drop ipv6 request")
+
+		return emptyResponse(req)
+	}
+
+	if !h.allDNS && !h.rules.covers(req.Question[0].Name) {
+		return errorResponse(req, dns.RcodeRefused)
+	}
+
+	return h.serveDirect(ctx, req)
+}
+
+// resolve asks protocol for req and learns routes from the answer, it reports
+// whether the protocol does not know the name.
+func (h *tunTransportHandler) resolve(ctx context.Context, protocol Protocol, req *dns.Msg) (*dns.Msg, bool) {
+	if isIPV6Request(req) && !h.protocolIPv6(protocol) {
+		log.Debug().Msg("DNS", "drop ipv6 request")
+
+		return emptyResponse(req), false
+	}
+
+	rsp, err := h.cache.lookup(ctx, protocol, req.Copy(), protocol.LookupHost)
+	if err != nil {
+		log.Error().DNS(req).Err(err).Msg("DNS", "resolve host")
+
+		return errorResponse(req, dns.RcodeServerFailure), false
+	}
+
+	if isMiss(rsp) {
+		log.Debug().DNS(req).Str("rcode", dns.RcodeToString[rsp.Rcode]).Msg("DNS", "host not found")
+
+		return rsp, true
+	}
+
+	log.Info().DNS(rsp).Msg("DNS", "resolve host")
+
+	if protocol, ok := protocol.(protocolFixedIPs); ok {
+		if len(protocol.FixedIPs()) > 0 {
+			log.Debug().DNS(rsp).Msg("DNS", "use fixed ips")
+
+			return rsp, false
+		}
+	}
+
+	for _, ans := range rsp.Answer {
+		switch a := ans.(type) {
+		case *dns.A:
+			h.learn(a.A, protocol, a.Hdr.Ttl)
+		case *dns.AAAA:
+			h.learn(a.AAAA, protocol, a.Hdr.Ttl)
+		}
+	}
+
+	return rsp, false
+}
+
+// learn routes ip to protocol, addresses with a rule of their own are left to it.
+func (h *tunTransportHandler) learn(ip net.IP, protocol Protocol, ttl uint32) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		if _, ok := h.rules.matchAddr(addr); ok {
+			return
+		}
+	}
+
+	h.routes.learn(ip.String(), protocol, time.Duration(ttl)*time.Second)
+}
+
+// serveDirect resolves req with the upstreams for names outside of the tunnels.
+func (h *tunTransportHandler) serveDirect(ctx context.Context, req *dns.Msg) *dns.Msg {
+	rsp, err := upstream.Exchange(ctx, h.defaultUpstreams(), req)
+	if err != nil {
+		log.Error().DNS(req).Err(err).Msg("DNS", "handle local dns req")
+
+		return errorResponse(req, dns.RcodeServerFailure)
+	}
+
+	return rsp
+}
+
+// defaultUpstreams returns the configured upstreams for names outside of the
+// tunnels, or the nameservers the system used before warp started.
+func (h *tunTransportHandler) defaultUpstreams() []*upstream.Upstream {
+	if len(h.upstreams) > 0 {
+		return h.upstreams
+	}
+
+	var ups []*upstream.Upstream
+
+	for _, addr := range h.platform.OriginalDNS() {
+		up, err := upstream.New(addr, "udp", new(net.Dialer).DialContext)
+		if err != nil {
+			log.Warn().Str("server", addr).Err(err).Msg("DNS", "skip local dns server")
+
+			continue
+		}
+
+		ups = append(ups, up)
+	}
+
+	return ups
+}
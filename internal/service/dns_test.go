@@ -0,0 +1,264 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hostsProtocol answers names of example.com with the given number of A records,
+// lookups of slow wait until release is closed.
+type hostsProtocol struct {
+	fakeProtocol
+	hosts   map[string]int
+	slow    string
+	release chan struct{}
+}
+
+func (p *hostsProtocol) Domains() []string {
+	return []string{"example.com"}
+}
+
+func (p *hostsProtocol) LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	name := req.Question[0].Name
+
+	if name == p.slow {
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+
+	for i := 0; i < p.hosts[name]; i++ {
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(198, 18, byte(i>>8), byte(i)),
+		})
+	}
+
+	return rsp, nil
+}
+
+func newTestHandler(t *testing.T, protocol Protocol) *tunTransportHandler {
+	t.Helper()
+
+	rules, err := NewRules(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	platform := &fakePlatform{}
+
+	return newTunTransportHandler(newRoutes("utun9", platform, time.Minute, 0), &Traffic{}, newDNSCache(0, 0), nil, platform, []Protocol{protocol}, rules, nil, false, false)
+}
+
+// serveDNS runs serve on one end of a pipe and returns the other end.
+func serveDNS(t *testing.T, serve func(context.Context, net.Conn)) net.Conn {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, server := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		serve(ctx, server)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		client.Close()
+		<-done
+	})
+
+	if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func query(id uint16, qtype uint16, names ...string) *dns.Msg {
+	req := new(dns.Msg)
+	req.Id = id
+	req.RecursionDesired = true
+
+	for _, name := range names {
+		req.Question = append(req.Question, dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET})
+	}
+
+	return req
+}
+
+func TestDNSTCPPipelined(t *testing.T) {
+	protocol := &hostsProtocol{
+		hosts:   map[string]int{"slow.example.com.": 1, "fast.example.com.": 2},
+		slow:    "slow.example.com.",
+		release: make(chan struct{}),
+	}
+	conn := serveDNS(t, newTestHandler(t, protocol).handleDNSTCP)
+
+	var msg []byte
+
+	for _, req := range []*dns.Msg{query(1, dns.TypeA, "slow.example.com."), query(2, dns.TypeA, "fast.example.com.")} {
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(b)))
+		msg = append(msg, b...)
+	}
+
+	// Both queries go out in one write before any answer is read.
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() *dns.Msg {
+		t.Helper()
+
+		var length uint16
+
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, length)
+
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatal(err)
+		}
+
+		rsp := new(dns.Msg)
+
+		if err := rsp.Unpack(b); err != nil {
+			t.Fatal(err)
+		}
+
+		return rsp
+	}
+
+	// The second answer does not wait for the first query.
+	if rsp := read(); rsp.Id != 2 || len(rsp.Answer) != 2 {
+		t.Fatalf("first answer: id %d with %d records, want id 2 with 2", rsp.Id, len(rsp.Answer))
+	}
+
+	close(protocol.release)
+
+	if rsp := read(); rsp.Id != 1 || len(rsp.Answer) != 1 {
+		t.Fatalf("second answer: id %d with %d records, want id 1 with 1", rsp.Id, len(rsp.Answer))
+	}
+}
+
+func TestDNSUDPTruncated(t *testing.T) {
+	protocol := &hostsProtocol{hosts: map[string]int{"many.example.com.": 200}}
+	conn := serveDNS(t, newTestHandler(t, protocol).handleDNSUDP)
+
+	tests := []struct {
+		edns int
+		size int
+	}{
+		{0, dns.MinMsgSize},
+		{100, dns.MinMsgSize},
+		{1232, 1232},
+		{dns.MaxMsgSize, dns.MaxMsgSize},
+	}
+
+	for i, tt := range tests {
+		req := query(uint16(i+1), dns.TypeA, "many.example.com.")
+		if tt.edns != 0 {
+			req.SetEdns0(uint16(tt.edns), false)
+		}
+
+		b, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, dns.MaxMsgSize)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rsp := new(dns.Msg)
+
+		if err := rsp.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+
+		if n > tt.size {
+			t.Errorf("edns %d: answer of %d bytes, want at most %d", tt.edns, n, tt.size)
+		}
+
+		// 200 records do not fit into 1232 bytes but do fit into 64k.
+		if truncated := tt.size < dns.MaxMsgSize; rsp.Truncated != truncated {
+			t.Errorf("edns %d: truncated %v, want %v", tt.edns, rsp.Truncated, truncated)
+		}
+
+		if !rsp.Truncated && len(rsp.Answer) != 200 {
+			t.Errorf("edns %d: %d records, want 200", tt.edns, len(rsp.Answer))
+		}
+
+		if (tt.edns != 0) != (rsp.IsEdns0() != nil) {
+			t.Errorf("edns %d: answer edns %v", tt.edns, rsp.IsEdns0())
+		}
+	}
+}
+
+func TestDNSQuestionsMerged(t *testing.T) {
+	protocol := &hostsProtocol{hosts: map[string]int{"a.example.com.": 1, "b.example.com.": 2}}
+	conn := serveDNS(t, newTestHandler(t, protocol).handleDNSUDP)
+
+	b, err := query(7, dns.TypeA, "a.example.com.", "b.example.com.").Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp := new(dns.Msg)
+
+	if err := rsp.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+
+	if rsp.Id != 7 || rsp.Rcode != dns.RcodeSuccess || len(rsp.Question) != 2 {
+		t.Fatalf("answer: id %d rcode %s with %d questions", rsp.Id, dns.RcodeToString[rsp.Rcode], len(rsp.Question))
+	}
+
+	names := make(map[string]int)
+
+	for _, rr := range rsp.Answer {
+		names[rr.Header().Name]++
+	}
+
+	if names["a.example.com."] != 1 || names["b.example.com."] != 2 {
+		t.Fatalf("merged answer: %v", rsp.Answer)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/sys"
+)
+
+// fakePlatform is a sys.Platform that records the calls made to it.
+type fakePlatform struct {
+	calls []string
+	mx    sync.Mutex
+}
+
+var _ sys.Platform = (*fakePlatform)(nil)
+
+func (p *fakePlatform) record(format string, args ...any) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.calls = append(p.calls, fmt.Sprintf(format, args...))
+}
+
+// take returns the calls recorded since the last take.
+func (p *fakePlatform) take() []string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	calls := p.calls
+	p.calls = nil
+
+	return calls
+}
+
+func (p *fakePlatform) CreateTun(name string, ips []netip.Addr, mtu uint32) error {
+	p.record("create tun %s %v %d", name, ips, mtu)
+
+	return nil
+}
+
+func (p *fakePlatform) DeleteTun(name string) error {
+	p.record("delete tun %s", name)
+
+	return nil
+}
+
+func (p *fakePlatform) DeleteAddr(addr netip.Addr, iface string) error {
+	p.record("delete addr %s %s", addr, iface)
+
+	return nil
+}
+
+func (p *fakePlatform) AddRoute(destination netip.Prefix, iface string) error {
+	p.record("add route %s %s", destination, iface)
+
+	return nil
+}
+
+func (p *fakePlatform) DeleteRoute(destination netip.Prefix, iface string) error {
+	p.record("delete route %s %s", destination, iface)
+
+	return nil
+}
+
+func (p *fakePlatform) SetSplitDNS(iface string, addr netip.Addr, domain string) error {
+	p.record("set split dns %s %s %s", iface, addr, domain)
+
+	return nil
+}
+
+func (p *fakePlatform) RestoreSplitDNS(iface, domain string) error {
+	p.record("restore split dns %s %s", iface, domain)
+
+	return nil
+}
+
+func (p *fakePlatform) SetGlobalDNS(iface string, servers []netip.Addr) (sys.DNSState, error) {
+	p.record("set global dns %s %v", iface, servers)
+
+	return sys.DNSState("state"), nil
+}
+
+func (p *fakePlatform) RestoreGlobalDNS(iface string, state sys.DNSState) error {
+	p.record("restore global dns %s %s", iface, state)
+
+	return nil
+}
+
+func (p *fakePlatform) OriginalDNS() []string {
+	return []string{"192.0.2.53"}
+}
+
+// fakeProtocol is a Protocol that is only compared by identity.
+type fakeProtocol struct {
+	name string
+}
+
+func (p *fakeProtocol) Domains() []string {
+	return nil
+}
+
+func (p *fakeProtocol) LookupHost(context.Context, *dns.Msg) (*dns.Msg, error) {
+	return nil, fmt.Errorf("%s: no lookups", p.name)
+}
@@ -0,0 +1,359 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/seancfoley/ipaddress-go/ipaddr"
+
+	"github.com/merzzzl/warp/internal/utils/log"
+	"github.com/merzzzl/warp/internal/utils/network"
+	"github.com/merzzzl/warp/internal/utils/sys"
+)
+
+type Routes struct {
+	table    *routeTrie
+	expires  map[netip.Prefix]time.Time
+	gateway  string
+	platform sys.Platform
+	minTTL   time.Duration
+	grace    time.Duration
+	direct   []netip.Prefix
+	mutex    sync.RWMutex
+	// changing serializes changes of system routes, the table is only locked
+	// around its own updates so lookups never wait for the platform.
+	changing sync.Mutex
+}
+
+var (
+	defaultRouteMinTTL = time.Minute
+	defaultRouteGrace  = 5 * time.Minute
+	routeSweepInterval = 10 * time.Second
+)
+
+func newRoutes(gateway string, platform sys.Platform, minTTL, grace time.Duration) *Routes {
+	if minTTL <= 0 {
+		minTTL = defaultRouteMinTTL
+	}
+
+	if grace < 0 {
+		grace = 0
+	}
+
+	return &Routes{
+		table:    newRouteTrie(),
+		expires:  make(map[netip.Prefix]time.Time),
+		gateway:  gateway,
+		platform: platform,
+		minTTL:   minTTL,
+		grace:    grace,
+	}
+}
+
+// GetAll returns all routes.
+func (r *Routes) GetAll() []string {
+	r.mutex.RLock()
+
+	ips := make([]*ipaddr.IPAddress, 0, r.table.size)
+
+	r.table.walk(func(prefix netip.Prefix, _ Protocol) {
+		if ip := ipaddr.NewIPAddressString(prefix.String()).GetAddress(); ip != nil {
+			ips = append(ips, ip)
+		}
+	})
+
+	r.mutex.RUnlock()
+
+	ipsv4, ipsv6 := ipaddr.MergeToPrefixBlocks(ips...)
+	ipsv4 = append(ipsv4, ipsv6...)
+
+	list := make([]string, 0, len(ipsv4))
+
+	for _, ip := range ipsv4 {
+		list = append(list, ip.String())
+	}
+
+	return list
+}
+
+// get returns the protocol of the most specific route to the address of addr.
+func (r *Routes) get(addr net.Addr) Protocol {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, hand, ok := r.table.lookup(addrPort.Addr())
+	if !ok {
+		return nil
+	}
+
+	return hand
+}
+
+// add adds a permanent route.
+func (r *Routes) add(ip string, hand Protocol) {
+	r.addRoute(ip, hand, 0)
+}
+
+// learn adds a route learned from a DNS answer, it expires after ttl unless
+// the answer is seen again.
+func (r *Routes) learn(ip string, hand Protocol, ttl time.Duration) {
+	r.addRoute(ip, hand, max(ttl, r.minTTL)+r.grace)
+}
+
+// exclude keeps the direct prefixes out of the routes added from now on, so
+// flows to them do not end up in the tunnel.
+func (r *Routes) exclude(direct []netip.Prefix) {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	r.direct = direct
+}
+
+func (r *Routes) addRoute(ip string, hand Protocol, ttl time.Duration) {
+	prefix, err := sys.ParsePrefix(ip)
+	if err != nil {
+		log.Error().Err(err).Str("ip", ip).Msg("TUN", "add route")
+
+		return
+	}
+
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	parts := without(prefix, r.direct)
+	if len(parts) == 0 {
+		log.Debug().Str("ip", ip).Msg("TUN", "keep direct route")
+
+		return
+	}
+
+	for _, part := range parts {
+		r.addPrefix(part, hand, ttl)
+	}
+}
+
+// addPrefix routes prefix into the tunnel, r.changing must be held.
+func (r *Routes) addPrefix(prefix netip.Prefix, hand Protocol, ttl time.Duration) {
+	ip := prefix.String()
+
+	r.mutex.Lock()
+	exists := r.refresh(prefix, hand, ttl)
+	r.mutex.Unlock()
+
+	if exists {
+		return
+	}
+
+	if err := r.platform.AddRoute(prefix, r.gateway); err != nil {
+		log.Error().Err(err).Str("ip", ip).Msg("TUN", "add route")
+
+		return
+	}
+
+	r.mutex.Lock()
+
+	r.table.insert(prefix, hand)
+
+	if ttl != 0 {
+		r.expires[prefix] = time.Now().Add(ttl)
+	}
+
+	r.mutex.Unlock()
+
+	log.Info().Str("ip", ip).Msg("TUN", "add route")
+}
+
+// refresh updates the table when the system already routes prefix into the
+// tunnel and reports whether it did. A permanent route keeps its protocol and
+// never gets an expiry.
+func (r *Routes) refresh(prefix netip.Prefix, hand Protocol, ttl time.Duration) bool {
+	deadline := time.Now().Add(ttl)
+
+	if owner, ok := r.table.get(prefix); ok {
+		expire, learned := r.expires[prefix]
+
+		switch {
+		case !learned && ttl != 0:
+			log.Debug().Str("ip", prefix.String()).Msg("TUN", "keep permanent route")
+
+			return true
+		case ttl == 0:
+			delete(r.expires, prefix)
+		case owner != hand || deadline.After(expire):
+			r.expires[prefix] = deadline
+		}
+
+		r.table.insert(prefix, hand)
+
+		return true
+	}
+
+	// A learned address inside a route of the same protocol needs no route of its own.
+	exists, owner, ok := r.table.lookup(prefix.Addr())
+	if !ok || ttl == 0 || exists.Bits() > prefix.Bits() || owner != hand {
+		return false
+	}
+
+	if expire, ok := r.expires[exists]; ok && deadline.After(expire) {
+		r.expires[exists] = deadline
+	}
+
+	log.Debug().Str("ip", prefix.String()).Str("exists", exists.String()).Msg("TUN", "add route")
+
+	return true
+}
+
+// expire periodically removes learned routes whose TTL ran out, routes that
+// still carry open connections are kept until those are closed.
+func (r *Routes) expire(ctx context.Context) {
+	ticker := time.NewTicker(routeSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sweep(now)
+		}
+	}
+}
+
+func (r *Routes) sweep(now time.Time) {
+	var expired []netip.Prefix
+
+	r.mutex.RLock()
+
+	for prefix, expire := range r.expires {
+		if !now.Before(expire) {
+			expired = append(expired, prefix)
+		}
+	}
+
+	r.mutex.RUnlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	active := network.ActiveAddrs()
+
+	for _, prefix := range expired {
+		if !inUse(prefix, active) {
+			r.expireRoute(prefix, now)
+		}
+	}
+}
+
+// expireRoute deletes the learned route to prefix unless it was refreshed
+// after the sweep saw it expired.
+func (r *Routes) expireRoute(prefix netip.Prefix, now time.Time) {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	r.mutex.RLock()
+	expire, ok := r.expires[prefix]
+	r.mutex.RUnlock()
+
+	if !ok || now.Before(expire) {
+		return
+	}
+
+	if err := r.platform.DeleteRoute(prefix, r.gateway); err != nil {
+		log.Error().Err(err).Str("ip", prefix.String()).Msg("TUN", "expire route")
+
+		return
+	}
+
+	r.mutex.Lock()
+	r.table.delete(prefix)
+	delete(r.expires, prefix)
+	r.mutex.Unlock()
+
+	log.Info().Str("ip", prefix.String()).Msg("TUN", "expire route")
+}
+
+// without returns the parts of prefix outside of the holes.
+func without(prefix netip.Prefix, holes []netip.Prefix) []netip.Prefix {
+	for _, hole := range holes {
+		if !hole.Overlaps(prefix) {
+			continue
+		}
+
+		if hole.Bits() <= prefix.Bits() {
+			return nil
+		}
+
+		low, high := split(prefix)
+
+		return append(without(low, holes), without(high, holes)...)
+	}
+
+	return []netip.Prefix{prefix}
+}
+
+// split returns the two halves of prefix.
+func split(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits()
+	b := prefix.Addr().AsSlice()
+	b[bits/8] |= 0x80 >> (bits % 8)
+
+	high, _ := netip.AddrFromSlice(b)
+
+	return netip.PrefixFrom(prefix.Addr(), bits+1), netip.PrefixFrom(high, bits+1)
+}
+
+func inUse(prefix netip.Prefix, active map[netip.Addr]struct{}) bool {
+	if prefix.IsSingleIP() {
+		_, ok := active[prefix.Addr()]
+
+		return ok
+	}
+
+	for addr := range active {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flush removes every route from the system and the table.
+func (r *Routes) flush() {
+	r.changing.Lock()
+	defer r.changing.Unlock()
+
+	var prefixes []netip.Prefix
+
+	r.mutex.RLock()
+
+	r.table.walk(func(prefix netip.Prefix, _ Protocol) {
+		prefixes = append(prefixes, prefix)
+	})
+
+	r.mutex.RUnlock()
+
+	for _, prefix := range prefixes {
+		if err := r.platform.DeleteRoute(prefix, r.gateway); err != nil {
+			log.Error().Err(err).Str("ip", prefix.String()).Msg("TUN", "delete route")
+
+			continue
+		}
+
+		r.mutex.Lock()
+		r.table.delete(prefix)
+		delete(r.expires, prefix)
+		r.mutex.Unlock()
+
+		log.Debug().Str("ip", prefix.String()).Msg("TUN", "delete route")
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRoutesPlatformCalls(t *testing.T) {
+	platform := &fakePlatform{}
+	routes := newRoutes("utun9", platform, time.Minute, 0)
+	p := &fakeProtocol{name: "p"}
+
+	routes.add("10.0.0.0/8", p)
+	routes.learn("192.0.2.1", p, time.Minute)
+	routes.learn("2001:db8::1", p, time.Hour)
+
+	// Addresses covered by a route of the same protocol are not added again.
+	routes.learn("10.1.2.3", p, time.Minute)
+
+	want := []string{
+		"add route 10.0.0.0/8 utun9",
+		"add route 192.0.2.1/32 utun9",
+		"add route 2001:db8::1/128 utun9",
+	}
+	if got := platform.take(); !slices.Equal(got, want) {
+		t.Fatalf("add: got %q, want %q", got, want)
+	}
+
+	if got := routes.get(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}); got != p {
+		t.Fatalf("get learned route: got %v", got)
+	}
+
+	routes.sweep(time.Now())
+
+	if got := platform.take(); len(got) != 0 {
+		t.Fatalf("sweep before expiry: got %q", got)
+	}
+
+	routes.sweep(time.Now().Add(2 * time.Minute))
+
+	want = []string{"delete route 192.0.2.1/32 utun9"}
+	if got := platform.take(); !slices.Equal(got, want) {
+		t.Fatalf("expire: got %q, want %q", got, want)
+	}
+
+	if got := routes.get(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}); got != nil {
+		t.Fatalf("get expired route: got %v", got)
+	}
+
+	routes.flush()
+
+	want = []string{
+		"delete route 10.0.0.0/8 utun9",
+		"delete route 2001:db8::1/128 utun9",
+	}
+	if got := platform.take(); !slices.Equal(got, want) {
+		t.Fatalf("flush: got %q, want %q", got, want)
+	}
+
+	if all := routes.GetAll(); len(all) != 0 {
+		t.Fatalf("routes after flush: %q", all)
+	}
+}
+
+func TestRoutesKeepPermanent(t *testing.T) {
+	platform := &fakePlatform{}
+	routes := newRoutes("utun9", platform, time.Minute, 0)
+	a, b := &fakeProtocol{name: "a"}, &fakeProtocol{name: "b"}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+
+	routes.add("192.0.2.1", a)
+	routes.learn("192.0.2.1", b, time.Minute)
+
+	if got := routes.get(addr); got != a {
+		t.Fatalf("learned answer took a permanent route: got %v", got)
+	}
+
+	routes.sweep(time.Now().Add(time.Hour))
+
+	if got := routes.get(addr); got != a {
+		t.Fatalf("permanent route expired: got %v", got)
+	}
+
+	// A learned route becomes permanent when it is added as one.
+	routes.learn("192.0.2.2", b, time.Minute)
+	routes.add("192.0.2.2", a)
+	routes.sweep(time.Now().Add(time.Hour))
+
+	if got := routes.get(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}); got != a {
+		t.Fatalf("upgraded route: got %v", got)
+	}
+
+	want := []string{
+		"add route 192.0.2.1/32 utun9",
+		"add route 192.0.2.2/32 utun9",
+	}
+	if got := platform.take(); !slices.Equal(got, want) {
+		t.Fatalf("platform calls: got %q, want %q", got, want)
+	}
+}
+
+// lookupPlatform looks a route up while the route is deleted.
+type lookupPlatform struct {
+	*fakePlatform
+	routes *Routes
+	got    Protocol
+}
+
+func (p *lookupPlatform) DeleteRoute(destination netip.Prefix, iface string) error {
+	p.got = p.routes.get(&net.UDPAddr{IP: destination.Addr().AsSlice(), Port: 53})
+
+	return p.fakePlatform.DeleteRoute(destination, iface)
+}
+
+func TestRoutesSweepUnlocked(t *testing.T) {
+	platform := &lookupPlatform{fakePlatform: &fakePlatform{}}
+	routes := newRoutes("utun9", platform, time.Minute, 0)
+	platform.routes = routes
+	p := &fakeProtocol{name: "p"}
+
+	routes.learn("192.0.2.1", p, time.Minute)
+
+	done := make(chan struct{})
+
+	go func() {
+		routes.sweep(time.Now().Add(time.Hour))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweep holds the table lock while deleting routes")
+	}
+
+	if platform.got != p {
+		t.Fatalf("lookup during delete: got %v", platform.got)
+	}
+}
+
+func TestRoutesExcludeDirect(t *testing.T) {
+	platform := &fakePlatform{}
+	routes := newRoutes("utun9", platform, time.Minute, 0)
+	p := &fakeProtocol{name: "p"}
+
+	routes.exclude([]netip.Prefix{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParsePrefix("2001:db8::/64")})
+
+	routes.add("10.0.0.0/14", p)
+	routes.add("10.1.2.0/24", p)
+	routes.learn("10.1.2.3", p, time.Minute)
+	routes.learn("2001:db8::1", p, time.Minute)
+	routes.learn("2001:db8:1::1", p, time.Minute)
+
+	want := []string{
+		"add route 10.0.0.0/16 utun9",
+		"add route 10.2.0.0/15 utun9",
+		"add route 2001:db8:1::1/128 utun9",
+	}
+	if got := platform.take(); !slices.Equal(got, want) {
+		t.Fatalf("add: got %q, want %q", got, want)
+	}
+
+	for addr, want := range map[string]Protocol{"10.0.0.1": p, "10.1.2.3": nil, "10.3.255.255": p, "2001:db8::1": nil} {
+		if got := routes.get(&net.TCPAddr{IP: net.ParseIP(addr), Port: 443}); got != want {
+			t.Errorf("get %s: got %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestWithout(t *testing.T) {
+	tests := []struct {
+		prefix string
+		holes  []string
+		want   []string
+	}{
+		{"10.0.0.0/8", nil, []string{"10.0.0.0/8"}},
+		{"10.0.0.0/8", []string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}},
+		{"10.1.2.3/32", []string{"10.0.0.0/8"}, nil},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, nil},
+		{"10.0.0.0/30", []string{"10.0.0.1/32"}, []string{"10.0.0.0/32", "10.0.0.2/31"}},
+		{"10.0.0.0/29", []string{"10.0.0.0/31", "10.0.0.6/32"}, []string{"10.0.0.2/31", "10.0.0.4/31", "10.0.0.7/32"}},
+		{"::/0", []string{"8000::/1"}, []string{"::/1"}},
+	}
+
+	for _, tt := range tests {
+		var holes []netip.Prefix
+		for _, hole := range tt.holes {
+			holes = append(holes, netip.MustParsePrefix(hole))
+		}
+
+		var got []string
+		for _, part := range without(netip.MustParsePrefix(tt.prefix), holes) {
+			got = append(got, part.String())
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s without %q: got %q, want %q", tt.prefix, tt.holes, got, tt.want)
+		}
+	}
+}
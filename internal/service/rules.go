@@ -0,0 +1,430 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	actionDirect = "direct"
+	actionReject = "reject"
+)
+
+var (
+	errRuleAction   = errors.New("rule needs either a protocol or a direct or reject action")
+	errRuleProtocol = errors.New("rule names an unknown protocol")
+	errRuleMixed    = errors.New("rule matches both names and addresses")
+	errRuleMatcher  = errors.New("invalid rule matcher")
+)
+
+// RuleConfig is an entry of the rules section. A flow or DNS query takes the
+// first rule whose matchers all match, a rule without matchers takes every
+// name that is left.
+type RuleConfig struct {
+	Match    Matchers `yaml:"match"`
+	Protocol string   `yaml:"protocol"`
+	Action   string   `yaml:"action"`
+}
+
+// Matchers is a list of matchers. In YAML it is either a list or a single
+// comma separated string.
+type Matchers []string
+
+// Rules routes names and addresses by an ordered list of rules before the
+// domains and ips of the protocols are looked at.
+type Rules struct {
+	list []*rule
+}
+
+type rule struct {
+	matchers []*matcher
+	protocol Protocol
+	name     string
+	action   string
+	addr     bool
+}
+
+// ruleResult is the decision of a rule, protocol is nil for direct and reject.
+type ruleResult struct {
+	protocol Protocol
+	name     string
+	action   string
+}
+
+type matcherKind int
+
+const (
+	matchExact matcherKind = iota
+	matchSuffix
+	matchWildcard
+	matchRegex
+	matchCIDR
+)
+
+// matcher is a single condition of a rule:
+//
+//	db.corp.example.com  exact name
+//	.corp.example.com    the name and all its subdomains
+//	*.corp.example.com   wildcard, * matches within one label
+//	/^db-[0-9]+\./       regular expression on the name
+//	10.0.0.0/8           address in the prefix, a bare address is a single IP
+//	!...                 negation of any of the above
+type matcher struct {
+	kind   matcherKind
+	negate bool
+	value  string
+	re     *regexp.Regexp
+	prefix netip.Prefix
+}
+
+// NewRules parses the rules, protocols maps the names rules refer to.
+func NewRules(cfgs []RuleConfig, protocols map[string]Protocol) (*Rules, error) {
+	r := &Rules{list: make([]*rule, 0, len(cfgs))}
+
+	for i, cfg := range cfgs {
+		rl, err := newRule(cfg, protocols)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+
+		r.list = append(r.list, rl)
+	}
+
+	return r, nil
+}
+
+func newRule(cfg RuleConfig, protocols map[string]Protocol) (*rule, error) {
+	rl := &rule{name: cfg.Protocol, action: cfg.Action}
+
+	switch {
+	case cfg.Protocol != "" && cfg.Action == "":
+		protocol, ok := protocols[cfg.Protocol]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errRuleProtocol, cfg.Protocol)
+		}
+
+		rl.protocol = protocol
+	case cfg.Protocol == "" && (cfg.Action == actionDirect || cfg.Action == actionReject):
+		rl.name = cfg.Action
+	default:
+		return nil, errRuleAction
+	}
+
+	for i, s := range cfg.Match {
+		m, err := newMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 && rl.addr != (m.kind == matchCIDR) {
+			return nil, errRuleMixed
+		}
+
+		rl.addr = m.kind == matchCIDR
+		rl.matchers = append(rl.matchers, m)
+	}
+
+	return rl, nil
+}
+
+func newMatcher(s string) (*matcher, error) {
+	m := &matcher{}
+
+	s = strings.TrimSpace(s)
+	s, m.negate = strings.CutPrefix(s, "!")
+
+	if s == "" {
+		return nil, errRuleMatcher
+	}
+
+	if len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errRuleMatcher, s, err)
+		}
+
+		m.kind, m.re = matchRegex, re
+
+		return m, nil
+	}
+
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		m.kind, m.prefix = matchCIDR, prefix.Masked()
+
+		return m, nil
+	}
+
+	if addr, err := netip.ParseAddr(s); err == nil {
+		m.kind, m.prefix = matchCIDR, netip.PrefixFrom(addr, addr.BitLen())
+
+		return m, nil
+	}
+
+	s = normalizeName(s)
+
+	switch {
+	case strings.Contains(s, "*"):
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, `[^.]*`)
+
+		m.kind, m.value, m.re = matchWildcard, s, regexp.MustCompile("^"+pattern+"$")
+	case strings.HasPrefix(s, "."):
+		m.kind, m.value = matchSuffix, strings.TrimPrefix(s, ".")
+	default:
+		m.kind, m.value = matchExact, s
+	}
+
+	if m.value == "" {
+		return nil, fmt.Errorf("%w: %s", errRuleMatcher, s)
+	}
+
+	return m, nil
+}
+
+// matchName returns the decision of the first name rule for name.
+func (r *Rules) matchName(name string) (ruleResult, bool) {
+	if r == nil {
+		return ruleResult{}, false
+	}
+
+	name = normalizeName(name)
+
+	for _, rl := range r.list {
+		if rl.addr {
+			continue
+		}
+
+		if rl.matches(func(m *matcher) bool { return m.matchName(name) }) {
+			return rl.result(), true
+		}
+	}
+
+	return ruleResult{}, false
+}
+
+// matchAddr returns the decision of the first address rule for addr.
+func (r *Rules) matchAddr(addr netip.Addr) (ruleResult, bool) {
+	if r == nil {
+		return ruleResult{}, false
+	}
+
+	addr = addr.Unmap()
+
+	for _, rl := range r.list {
+		if !rl.addr {
+			continue
+		}
+
+		if rl.matches(func(m *matcher) bool { return m.prefix.Contains(addr) }) {
+			return rl.result(), true
+		}
+	}
+
+	return ruleResult{}, false
+}
+
+// routes returns the prefixes that address rules send into the tunnel, the
+// narrowest prefix of each rule since all matchers of a rule must match. The
+// protocol is nil for rejected prefixes.
+func (r *Rules) routes() map[netip.Prefix]Protocol {
+	routes := make(map[netip.Prefix]Protocol)
+
+	if r == nil {
+		return routes
+	}
+
+	for _, rl := range r.list {
+		if !rl.addr || rl.action == actionDirect {
+			continue
+		}
+
+		if prefix, ok := rl.narrowest(); ok {
+			if _, ok := routes[prefix]; !ok {
+				routes[prefix] = rl.protocol
+			}
+		}
+	}
+
+	return routes
+}
+
+// direct returns the prefixes that address rules keep out of the tunnel, the
+// narrowest prefix of each direct rule without negations. A prefix an earlier
+// rule takes part of stays routed, so is every prefix after a negation.
+func (r *Rules) direct() []netip.Prefix {
+	if r == nil {
+		return nil
+	}
+
+	var direct, taken []netip.Prefix
+
+	for _, rl := range r.list {
+		if !rl.addr {
+			continue
+		}
+
+		if rl.action != actionDirect {
+			for _, m := range rl.matchers {
+				if m.negate {
+					return direct
+				}
+
+				taken = append(taken, m.prefix)
+			}
+
+			continue
+		}
+
+		prefix, ok := rl.narrowest()
+		if ok && !rl.negated() && !slices.ContainsFunc(taken, prefix.Overlaps) {
+			direct = append(direct, prefix)
+		}
+	}
+
+	return direct
+}
+
+// narrowest returns the prefix of an address rule that all of its other
+// prefixes contain, negations cut holes into it and are left out.
+func (rl *rule) narrowest() (netip.Prefix, bool) {
+	var narrowest netip.Prefix
+
+	for _, m := range rl.matchers {
+		if !m.negate && (!narrowest.IsValid() || m.prefix.Bits() > narrowest.Bits()) {
+			narrowest = m.prefix
+		}
+	}
+
+	for _, m := range rl.matchers {
+		if !m.negate && !m.prefix.Overlaps(narrowest) {
+			return netip.Prefix{}, false
+		}
+	}
+
+	return narrowest, narrowest.IsValid()
+}
+
+func (rl *rule) negated() bool {
+	return slices.ContainsFunc(rl.matchers, func(m *matcher) bool {
+		return m.negate
+	})
+}
+
+// domains returns the domains that name rules send to a protocol or reject,
+// for split DNS. Regular expressions can only be served with global DNS.
+func (r *Rules) domains() []string {
+	if r == nil {
+		return nil
+	}
+
+	var list []string
+
+	for _, rl := range r.list {
+		if rl.addr || rl.action == actionDirect {
+			continue
+		}
+
+		for _, m := range rl.matchers {
+			if domain, ok := m.domain(); ok {
+				list = append(list, domain)
+			}
+		}
+	}
+
+	return list
+}
+
+// covers reports whether name is under one of the domains of the rules, the
+// system sends such names to warp even if no rule takes them.
+func (r *Rules) covers(name string) bool {
+	name = normalizeName(name)
+
+	for _, domain := range r.domains() {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rl *rule) matches(match func(m *matcher) bool) bool {
+	for _, m := range rl.matchers {
+		if match(m) == m.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rl *rule) result() ruleResult {
+	return ruleResult{
+		protocol: rl.protocol,
+		name:     rl.name,
+		action:   rl.action,
+	}
+}
+
+func (m *matcher) matchName(name string) bool {
+	switch m.kind {
+	case matchExact:
+		return name == m.value
+	case matchSuffix:
+		return name == m.value || strings.HasSuffix(name, "."+m.value)
+	case matchWildcard, matchRegex:
+		return m.re.MatchString(name)
+	default:
+		return false
+	}
+}
+
+// domain returns the domain that covers every name the matcher accepts.
+func (m *matcher) domain() (string, bool) {
+	if m.negate {
+		return "", false
+	}
+
+	switch m.kind {
+	case matchExact, matchSuffix:
+		return m.value, true
+	case matchWildcard:
+		labels := strings.Split(m.value, ".")
+
+		for i := len(labels) - 1; i >= 0; i-- {
+			if strings.Contains(labels[i], "*") {
+				domain := strings.Join(labels[i+1:], ".")
+
+				return domain, domain != ""
+			}
+		}
+	}
+
+	return "", false
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (m *Matchers) UnmarshalYAML(unmarshal func(any) error) error {
+	var list []string
+
+	if err := unmarshal(&list); err != nil {
+		var str string
+
+		if err := unmarshal(&str); err != nil {
+			return err
+		}
+
+		list = strings.Split(str, ",")
+	}
+
+	*m = list
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRulesDirect(t *testing.T) {
+	p := &fakeProtocol{name: "p"}
+
+	rules, err := NewRules([]RuleConfig{
+		{Match: Matchers{"10.1.0.0/16"}, Protocol: "p"},
+		{Match: Matchers{"10.1.2.0/24"}, Action: actionDirect},
+		{Match: Matchers{"10.0.0.0/8", "10.2.0.0/16"}, Action: actionDirect},
+		{Match: Matchers{"192.168.0.0/16", "10.3.0.0/16"}, Action: actionDirect},
+		{Match: Matchers{".corp.example.com"}, Action: actionDirect},
+		{Match: Matchers{"!172.16.0.0/12"}, Action: actionReject},
+		{Match: Matchers{"172.16.1.0/24"}, Action: actionDirect},
+	}, map[string]Protocol{"p": p})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10.1.2.0/24 goes to p by the first rule, a rule matching two disjoint
+	// prefixes never matches and nothing is direct after a negation.
+	want := []netip.Prefix{netip.MustParsePrefix("10.2.0.0/16")}
+	if got := rules.direct(); !slices.Equal(got, want) {
+		t.Fatalf("direct: got %v, want %v", got, want)
+	}
+}
+
+func TestNewMatcher(t *testing.T) {
+	tests := []struct {
+		s      string
+		kind   matcherKind
+		negate bool
+		value  string
+		prefix string
+		err    bool
+	}{
+		{s: "DB.Corp.Example.com.", kind: matchExact, value: "db.corp.example.com"},
+		{s: " .corp.example.com ", kind: matchSuffix, value: "corp.example.com"},
+		{s: "*.corp.example.com", kind: matchWildcard, value: "*.corp.example.com"},
+		{s: "/^db-[0-9]+\\./", kind: matchRegex},
+		{s: "10.1.2.3/8", kind: matchCIDR, prefix: "10.0.0.0/8"},
+		{s: "192.0.2.1", kind: matchCIDR, prefix: "192.0.2.1/32"},
+		{s: "2001:db8::1", kind: matchCIDR, prefix: "2001:db8::1/128"},
+		{s: "!.corp.example.com", kind: matchSuffix, negate: true, value: "corp.example.com"},
+		{s: "!10.0.0.0/8", kind: matchCIDR, negate: true, prefix: "10.0.0.0/8"},
+		{s: "", err: true},
+		{s: "!", err: true},
+		{s: ".", err: true},
+		{s: "/[/", err: true},
+	}
+
+	for _, tt := range tests {
+		m, err := newMatcher(tt.s)
+		if tt.err {
+			if !errors.Is(err, errRuleMatcher) {
+				t.Errorf("%q: got %v, want %v", tt.s, err, errRuleMatcher)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+
+			continue
+		}
+
+		if m.kind != tt.kind || m.negate != tt.negate || m.value != tt.value {
+			t.Errorf("%q: got kind %d negate %v value %q", tt.s, m.kind, m.negate, m.value)
+		}
+
+		if tt.prefix != "" && m.prefix != netip.MustParsePrefix(tt.prefix) {
+			t.Errorf("%q: got prefix %s, want %s", tt.s, m.prefix, tt.prefix)
+		}
+	}
+}
+
+func newTestRules(t *testing.T, cfgs []RuleConfig) (*Rules, map[string]Protocol) {
+	t.Helper()
+
+	protocols := map[string]Protocol{
+		"vpn":   &fakeProtocol{name: "vpn"},
+		"proxy": &fakeProtocol{name: "proxy"},
+	}
+
+	rules, err := NewRules(cfgs, protocols)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rules, protocols
+}
+
+func TestRulesMatchName(t *testing.T) {
+	rules, _ := newTestRules(t, []RuleConfig{
+		{Match: Matchers{"db.corp.example.com"}, Protocol: "proxy"},
+		{Match: Matchers{".corp.example.com", "!/^legacy-/"}, Protocol: "vpn"},
+		{Match: Matchers{"*.ads.example"}, Action: actionReject},
+		{Match: Matchers{"/^git-[0-9]+\\.example\\.org$/"}, Protocol: "proxy"},
+		{Match: Matchers{"10.0.0.0/8"}, Protocol: "proxy"},
+		{Match: Matchers{"public.example.com"}, Action: actionDirect},
+	})
+
+	tests := []struct {
+		name string
+		rule string
+	}{
+		// The exact rule comes first and wins over the suffix.
+		{"db.corp.example.com.", "proxy"},
+		{"DB.CORP.EXAMPLE.COM", "proxy"},
+		{"corp.example.com", "vpn"},
+		{"a.b.corp.example.com", "vpn"},
+		{"legacy-app.corp.example.com", ""},
+		{"notcorp.example.com", ""},
+		{"banner.ads.example", actionReject},
+		{"ads.example", ""},
+		{"a.banner.ads.example", ""},
+		{"git-12.example.org", "proxy"},
+		{"git-x.example.org", ""},
+		{"public.example.com", actionDirect},
+		{"10.1.2.3", ""},
+	}
+
+	for _, tt := range tests {
+		var got string
+
+		if res, ok := rules.matchName(tt.name); ok {
+			got = res.name
+		}
+
+		if got != tt.rule {
+			t.Errorf("%s: matched %q, want %q", tt.name, got, tt.rule)
+		}
+	}
+}
+
+func TestRulesMatchAddr(t *testing.T) {
+	rules, protocols := newTestRules(t, []RuleConfig{
+		{Match: Matchers{".corp.example.com"}, Protocol: "vpn"},
+		{Match: Matchers{"10.1.2.3"}, Action: actionDirect},
+		{Match: Matchers{"10.0.0.0/8", "!10.2.0.0/16"}, Protocol: "vpn"},
+		{Match: Matchers{"10.0.0.0/8", "10.2.3.0/24"}, Protocol: "proxy"},
+		{Match: Matchers{"2001:db8::/32"}, Action: actionReject},
+	})
+
+	tests := []struct {
+		addr   string
+		action string
+		proto  string
+	}{
+		{"10.1.2.3", actionDirect, ""},
+		{"::ffff:10.1.2.3", actionDirect, ""},
+		{"10.1.2.4", "", "vpn"},
+		{"10.2.3.4", "", "proxy"},
+		{"10.2.4.1", "", ""},
+		{"2001:db8::1", actionReject, ""},
+		{"192.0.2.1", "", ""},
+	}
+
+	for _, tt := range tests {
+		res, ok := rules.matchAddr(netip.MustParseAddr(tt.addr))
+
+		if ok != (tt.action != "" || tt.proto != "") {
+			t.Errorf("%s: matched %v", tt.addr, ok)
+
+			continue
+		}
+
+		if res.action != tt.action || (tt.proto != "" && res.protocol != protocols[tt.proto]) {
+			t.Errorf("%s: got %s %v, want %s %s", tt.addr, res.action, res.protocol, tt.action, tt.proto)
+		}
+	}
+
+	var none *Rules
+
+	if _, ok := none.matchAddr(netip.MustParseAddr("10.1.2.3")); ok {
+		t.Error("nil rules matched")
+	}
+}
+
+func TestRulesDomains(t *testing.T) {
+	rules, _ := newTestRules(t, []RuleConfig{
+		{Match: Matchers{"db.corp.example.com", ".vpn.example.com"}, Protocol: "vpn"},
+		{Match: Matchers{"*.ads.example", "!/tracker/"}, Action: actionReject},
+		{Match: Matchers{"git-*.dev.*.example.org"}, Protocol: "proxy"},
+		{Match: Matchers{"/^svc-/"}, Protocol: "proxy"},
+		{Match: Matchers{"*.*"}, Protocol: "proxy"},
+		{Match: Matchers{"public.example.com"}, Action: actionDirect},
+		{Match: Matchers{"10.0.0.0/8"}, Protocol: "vpn"},
+	})
+
+	want := []string{"db.corp.example.com", "vpn.example.com", "ads.example", "example.org"}
+	if got := rules.domains(); !slices.Equal(got, want) {
+		t.Fatalf("domains: got %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"db.corp.example.com.", true},
+		{"a.db.corp.example.com", true},
+		{"web.corp.example.com", false},
+		{"VPN.example.com", true},
+		{"x.ads.example", true},
+		{"git-1.dev.eu.example.org", true},
+		{"public.example.com", false},
+		{"svc-a.example.net", false},
+	}
+
+	for _, tt := range tests {
+		if got := rules.covers(tt.name); got != tt.want {
+			t.Errorf("covers %s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewRulesErrors(t *testing.T) {
+	tests := []struct {
+		cfg RuleConfig
+		err error
+	}{
+		{RuleConfig{Match: Matchers{".example.com"}}, errRuleAction},
+		{RuleConfig{Match: Matchers{".example.com"}, Action: "drop"}, errRuleAction},
+		{RuleConfig{Match: Matchers{".example.com"}, Protocol: "vpn", Action: actionDirect}, errRuleAction},
+		{RuleConfig{Match: Matchers{".example.com"}, Protocol: "tor"}, errRuleProtocol},
+		{RuleConfig{Match: Matchers{".example.com", "10.0.0.0/8"}, Protocol: "vpn"}, errRuleMixed},
+		{RuleConfig{Match: Matchers{"!10.0.0.0/8", "/^db/"}, Action: actionReject}, errRuleMixed},
+		{RuleConfig{Match: Matchers{"/(/"}, Protocol: "vpn"}, errRuleMatcher},
+	}
+
+	for _, tt := range tests {
+		_, err := NewRules([]RuleConfig{{Match: Matchers{".ok.example"}, Protocol: "vpn"}, tt.cfg}, map[string]Protocol{"vpn": &fakeProtocol{name: "vpn"}})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%+v: got %v, want %v", tt.cfg, err, tt.err)
+		}
+
+		if err != nil && !strings.HasPrefix(err.Error(), "rule 2: ") {
+			t.Errorf("%+v: error %q does not name the rule", tt.cfg, err)
+		}
+	}
+
+	// A rule without matchers takes every name.
+	rules, _ := newTestRules(t, []RuleConfig{{Protocol: "vpn"}})
+
+	if res, ok := rules.matchName("anything.example"); !ok || res.name != "vpn" {
+		t.Errorf("catch-all rule: got %v %v", res, ok)
+	}
+}
+
+func TestRulesRoutes(t *testing.T) {
+	rules, protocols := newTestRules(t, []RuleConfig{
+		{Match: Matchers{"10.0.0.0/8", "10.1.0.0/16"}, Protocol: "vpn"},
+		{Match: Matchers{"172.16.0.0/12", "!172.16.1.0/24"}, Protocol: "proxy"},
+		{Match: Matchers{"192.168.0.0/16", "10.2.0.0/16"}, Protocol: "proxy"},
+		{Match: Matchers{"10.1.0.0/16"}, Protocol: "proxy"},
+		{Match: Matchers{"!198.51.100.0/24"}, Action: actionReject},
+		{Match: Matchers{"2001:db8::/32"}, Action: actionReject},
+		{Match: Matchers{"203.0.113.0/24"}, Action: actionDirect},
+		{Match: Matchers{".corp.example.com"}, Protocol: "vpn"},
+	})
+
+	// Only the intersection of a rule is routed, disjoint prefixes never match
+	// and a rule of only negations has nothing to route.
+	want := map[netip.Prefix]Protocol{
+		netip.MustParsePrefix("10.1.0.0/16"):   protocols["vpn"],
+		netip.MustParsePrefix("172.16.0.0/12"): protocols["proxy"],
+		netip.MustParsePrefix("2001:db8::/32"): nil,
+	}
+
+	got := rules.routes()
+
+	if len(got) != len(want) {
+		t.Fatalf("routes: got %v, want %v", got, want)
+	}
+
+	for prefix, protocol := range want {
+		if p, ok := got[prefix]; !ok || p != protocol {
+			t.Errorf("route %s: got %v %v, want %v", prefix, p, ok, protocol)
+		}
+	}
+
+	// Every routed address matches the rule that routed it.
+	for prefix, protocol := range got {
+		res, ok := rules.matchAddr(prefix.Addr())
+		if !ok || res.protocol != protocol {
+			t.Errorf("route %s: %s matches %v %v", prefix, prefix.Addr(), res.protocol, ok)
+		}
+	}
+}
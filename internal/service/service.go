@@ -3,13 +3,12 @@ package service
 import (
 	"context"
 	"net"
-	"strings"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/seancfoley/ipaddress-go/ipaddr"
 	"github.com/xjasonlyu/tun2socks/v2/core"
 	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
 	"github.com/xjasonlyu/tun2socks/v2/core/device/tun"
@@ -17,12 +16,19 @@ import (
 
 	"github.com/merzzzl/warp/internal/utils/log"
 	"github.com/merzzzl/warp/internal/utils/sys"
+	"github.com/merzzzl/warp/internal/utils/upstream"
 )
 
 type Config struct {
-	Name     string `yaml:"name"`
-	IP       string `yaml:"ip"`
-	ServeDNS bool   `yaml:"serve_dns"`
+	Name        string        `yaml:"name"`
+	IP          string        `yaml:"ip"`
+	IP6         string        `yaml:"ip6"`
+	ServeDNS    bool          `yaml:"serve_dns"`
+	RouteMinTTL time.Duration `yaml:"route_min_ttl"`
+	RouteGrace  time.Duration `yaml:"route_grace"`
+	CacheSize   int           `yaml:"dns_cache_size"`
+	CacheStale  time.Duration `yaml:"dns_serve_stale"`
+	Upstream    []string      `yaml:"dns_upstream"`
 }
 
 type trafficConn struct {
@@ -39,15 +45,9 @@ type Traffic struct {
 	transferredOutSum          atomic.Int64
 }
 
-type Routes struct {
-	list    map[string]Protocol
-	gateway string
-	mutex   sync.RWMutex
-}
-
 type Protocol interface {
 	Domains() []string
-	LookupHost(ctx context.Context, req *dns.Msg) *dns.Msg
+	LookupHost(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 }
 
 type protocolFixedIPs interface {
@@ -62,58 +62,139 @@ type protocolHandleTCP interface {
 	HandleTCP(conn net.Conn)
 }
 
+type protocolIPv6 interface {
+	IPv6() bool
+}
+
+type protocolNoCache interface {
+	NoCache(req *dns.Msg) bool
+}
+
 type tunTransportHandler struct {
-	addr     string
+	platform sys.Platform
+	addrs    []string
 	tcpQueue chan adapter.TCPConn
 	udpQueue chan adapter.UDPConn
 	closeCh  chan struct{}
 	adapter.TransportHandler
 	routes    *Routes
 	traffic   *Traffic
+	cache     *DNSCache
+	upstreams []*upstream.Upstream
 	protocols []Protocol
+	rules     *Rules
 	ipv6      bool
 	allDNS    bool
 }
 
 type Service struct {
-	routes   *Routes
-	traffic  *Traffic
-	serveDNS bool
-	name     string
-	addr     string
+	routes    *Routes
+	traffic   *Traffic
+	cache     *DNSCache
+	upstreams []*upstream.Upstream
+	platform  sys.Platform
+	serveDNS  bool
+	name      string
+	addr      netip.Addr
+	addr6     netip.Addr
 }
 
-var defaultMTU uint32 = 1280
+var (
+	defaultMTU  uint32 = 1280
+	defaultIPv6        = netip.MustParseAddr("fd00:7761:7270::1")
+)
 
 // New create a tun device and return the Tunnel.
-func New(config *Config) (*Service, error) {
-	routes := &Routes{
-		gateway: config.Name,
-		list:    make(map[string]Protocol),
+func New(config *Config, platform sys.Platform) (*Service, error) {
+	if err := sys.ValidateIface(config.Name); err != nil {
+		return nil, err
+	}
+
+	addr, err := netip.ParseAddr(config.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	addr6 := defaultIPv6
+
+	if config.IP6 != "" {
+		addr6, err = netip.ParseAddr(config.IP6)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	upstreams, err := upstream.NewList(config.Upstream, "udp", new(net.Dialer).DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveUpstreams(upstreams, platform); err != nil {
+		return nil, err
 	}
 
+	routes := newRoutes(config.Name, platform, config.RouteMinTTL, config.RouteGrace)
+
 	traffic := &Traffic{
 		tarificationMutexLastCheck: time.Now(),
 	}
 
 	s := &Service{
-		name:     config.Name,
-		addr:     config.IP,
-		routes:   routes,
-		traffic:  traffic,
-		serveDNS: config.ServeDNS,
+		name:      config.Name,
+		addr:      addr,
+		addr6:     addr6,
+		routes:    routes,
+		traffic:   traffic,
+		cache:     newDNSCache(config.CacheSize, config.CacheStale),
+		upstreams: upstreams,
+		platform:  platform,
+		serveDNS:  config.ServeDNS,
 	}
 
 	return s, nil
 }
 
-func newTunTransportHandler(routes *Routes, traffic *Traffic, protocols []Protocol, addr string, ipv6, serveDNS bool) *tunTransportHandler {
+// resolveUpstreams looks up named upstreams once with the nameservers the system
+// used before warp started, the system resolver may be warp itself later on.
+func resolveUpstreams(ups []*upstream.Upstream, platform sys.Platform) error {
+	var original []*upstream.Upstream
+
+	for _, up := range ups {
+		if _, ok := up.Addr(); ok {
+			continue
+		}
+
+		if original == nil {
+			var err error
+
+			original, err = upstream.NewList(platform.OriginalDNS(), "udp", new(net.Dialer).DialContext)
+			if err != nil {
+				return err
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+		err := up.Resolve(ctx, original)
+
+		cancel()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newTunTransportHandler(routes *Routes, traffic *Traffic, cache *DNSCache, upstreams []*upstream.Upstream, platform sys.Platform, protocols []Protocol, rules *Rules, addrs []string, ipv6, serveDNS bool) *tunTransportHandler {
 	handler := &tunTransportHandler{
+		platform:  platform,
 		tcpQueue:  make(chan adapter.TCPConn, 128),
 		udpQueue:  make(chan adapter.UDPConn, 128),
 		closeCh:   make(chan struct{}, 1),
 		protocols: protocols,
-		addr:      addr,
+		rules:     rules,
+		addrs:     addrs,
 		ipv6:      ipv6,
 		allDNS:    serveDNS,
 	}
@@ -121,6 +202,8 @@ func newTunTransportHandler(routes *Routes, traffic *Traffic, protocols []Protoc
 	handler.TransportHandler = handler
 	handler.routes = routes
 	handler.traffic = traffic
+	handler.cache = cache
+	handler.upstreams = upstreams
 
 	return handler
 }
@@ -157,13 +240,18 @@ func (h *tunTransportHandler) HandleUDP(conn adapter.UDPConn) { h.udpQueue <- co
 func (h *tunTransportHandler) handleTCPConn(ctx context.Context, conn adapter.TCPConn) {
 	defer conn.Close()
 
-	if conn.ID().LocalPort == 53 && conn.ID().LocalAddress.String() == h.addr {
-		h.handleDNS(ctx, conn)
+	if h.isDNS(conn.ID().LocalPort, conn.ID().LocalAddress.String()) {
+		h.handleDNSTCP(ctx, conn)
 
 		return
 	}
 
-	if handler := h.routes.get(strings.Split(conn.LocalAddr().String(), ":")[0]); handler != nil {
+	handler, ok := h.route(conn.LocalAddr())
+	if !ok {
+		return
+	}
+
+	if handler != nil {
 		if handler, ok := handler.(protocolHandleTCP); ok {
 			handler.HandleTCP(h.traffic.newConn(conn))
 
@@ -177,13 +265,18 @@ func (h *tunTransportHandler) handleTCPConn(ctx context.Context, conn adapter.TC
 func (h *tunTransportHandler) handleUDPConn(ctx context.Context, conn adapter.UDPConn) {
 	defer conn.Close()
 
-	if conn.ID().LocalPort == 53 && conn.ID().LocalAddress.String() == h.addr {
-		h.handleDNS(ctx, conn)
+	if h.isDNS(conn.ID().LocalPort, conn.ID().LocalAddress.String()) {
+		h.handleDNSUDP(ctx, conn)
+
+		return
+	}
 
+	handler, ok := h.route(conn.LocalAddr())
+	if !ok {
 		return
 	}
 
-	if handler := h.routes.get(strings.Split(conn.LocalAddr().String(), ":")[0]); handler != nil {
+	if handler != nil {
 		if handler, ok := handler.(protocolHandleUDP); ok {
 			handler.HandleUDP(h.traffic.newConn(conn))
 
@@ -194,81 +287,54 @@ func (h *tunTransportHandler) handleUDPConn(ctx context.Context, conn adapter.UD
 	log.Warn().Msgf("TUN", "no handler for udp connection to: %s", conn.LocalAddr())
 }
 
-// GetRoutes returns Routes.
-func (t *Service) GetRoutes() *Routes {
-	return t.routes
-}
-
-// GetAll returns all routes.
-func (r *Routes) GetAll() []string {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
-	list := make([]string, 0, len(r.list))
-
-	for route := range r.list {
-		list = append(list, route)
+// route returns the protocol for a flow to addr, address rules come before the
+// routes. It reports false if a rule does not let the flow through the tunnel.
+func (h *tunTransportHandler) route(addr net.Addr) (Protocol, bool) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil, true
 	}
 
-	ips := make([]*ipaddr.IPAddress, 0, len(list))
-
-	for _, ipstr := range list {
-		addr := ipaddr.NewIPAddressString(ipstr)
-		if ip := addr.GetAddress(); ip != nil {
-			ips = append(ips, ip)
-		}
+	res, ok := h.rules.matchAddr(addrPort.Addr())
+	if !ok {
+		return h.routes.get(addr), true
 	}
 
-	ipsv4, ipsv6 := ipaddr.MergeToPrefixBlocks(ips...)
-	ipsv4 = append(ipsv4, ipsv6...)
+	switch res.action {
+	case actionReject:
+		log.Info().Str("dest", addr.String()).Msg("TUN", "reject by rule")
 
-	list = make([]string, 0, len(ipsv4))
+		return nil, false
+	case actionDirect:
+		log.Warn().Str("dest", addr.String()).Msg("TUN", "direct address is routed into the tunnel")
 
-	for _, ip := range ipsv4 {
-		list = append(list, ip.String())
+		return nil, false
 	}
 
-	return list
+	return res.protocol, true
 }
 
-func (r *Routes) get(route string) any {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
-
-	for k, v := range r.list {
-		if ipaddr.NewIPAddressString(k).Contains(ipaddr.NewIPAddressString(route)) {
-			return v
-		}
+func (h *tunTransportHandler) isDNS(port uint16, local string) bool {
+	if port != 53 {
+		return false
 	}
 
-	return nil
-}
-
-func (r *Routes) add(ip string, hand Protocol) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-
-	for k := range r.list {
-		if ipaddr.NewIPAddressString(k).Contains(ipaddr.NewIPAddressString(ip)) {
-			log.Debug().Str("ip", ip).Str("exists", k).Msg("TUN", "add route")
-
-			return
+	for _, addr := range h.addrs {
+		if local == addr {
+			return true
 		}
 	}
 
-	if err := sys.AddRoute(ip, r.gateway); err != nil {
-		log.Error().Err(err).Str("ip", ip).Msg("TUN", "add route")
-
-		return
-	}
-
-	r.list[ip] = hand
+	return false
+}
 
-	log.Info().Str("ip", ip).Msg("TUN", "add route")
+// GetRoutes returns Routes.
+func (t *Service) GetRoutes() *Routes {
+	return t.routes
 }
 
 // ListenAndServe listens on the given address and serves DNS requests using the provided resolvers.
-func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, ipv6 bool) error {
+func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, rules *Rules, ipv6 bool) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -277,7 +343,17 @@ func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, ipv6
 		return err
 	}
 
-	handler := newTunTransportHandler(t.routes, t.traffic, protocols, t.addr, ipv6, t.serveDNS)
+	addrs := []netip.Addr{t.addr}
+	if ipv6 {
+		addrs = append(addrs, t.addr6)
+	}
+
+	listen := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		listen = append(listen, addr.String())
+	}
+
+	handler := newTunTransportHandler(t.routes, t.traffic, t.cache, t.upstreams, t.platform, protocols, rules, listen, ipv6, t.serveDNS)
 
 	coreStack, err := core.CreateStack(&core.Config{
 		LinkEndpoint:     dev,
@@ -288,49 +364,52 @@ func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, ipv6
 		return err
 	}
 
-	err = sys.CreateTun(t.name, t.addr, defaultMTU)
+	err = t.platform.CreateTun(t.name, addrs, defaultMTU)
 	if err != nil {
 		return err
 	}
 
+	domains := rules.domains()
+
 	for _, p := range protocols {
-		domains := p.Domains()
-		if len(domains) == 0 {
-			continue
+		domains = append(domains, p.Domains()...)
+	}
+
+	if t.serveDNS && len(domains) != 0 {
+		state, err := t.platform.SetGlobalDNS(t.name, []netip.Addr{t.addr})
+		if err != nil {
+			return err
 		}
 
-		if t.serveDNS {
-			if err := sys.LSetDNS([]string{t.addr}); err != nil {
+		defer func() {
+			if err := t.platform.RestoreGlobalDNS(t.name, state); err != nil {
+				log.Error().Err(err).Msg("DNS", "restore dns")
+			}
+		}()
+	} else {
+		for i := range domains {
+			if err := t.platform.SetSplitDNS(t.name, t.addr, domains[i]); err != nil {
 				return err
 			}
 
-			defer func() {
-				if err := sys.LRestoreDNS(); err != nil {
+			defer func(domain string) {
+				if err := t.platform.RestoreSplitDNS(t.name, domain); err != nil {
 					log.Error().Err(err).Msg("DNS", "restore dns")
 				}
-			}()
-		} else {
-			for i := range domains {
-				if err := sys.SetDNS(t.addr, domains[i]); err != nil {
-					return err
-				}
-
-				defer func(domain string) {
-					if err := sys.RestoreDNS(domain); err != nil {
-						log.Error().Err(err).Msg("DNS", "restore dns")
-					}
-				}(domains[i])
-			}
+			}(domains[i])
 		}
 	}
 
-	log.Info().Str("host", t.addr+":53").Msg("TUN", "start tun interface")
-	defer log.Info().Str("host", t.addr+":53").Msg("TUN", "stop tun interface")
+	log.Info().Str("host", net.JoinHostPort(t.addr.String(), "53")).Msg("TUN", "start tun interface")
+	defer log.Info().Str("host", net.JoinHostPort(t.addr.String(), "53")).Msg("TUN", "stop tun interface")
 
 	go handler.run(ctx)
+	go t.routes.expire(ctx)
+
+	log.Info().Str("host", net.JoinHostPort(t.addr.String(), "53")).Msg("DNS", "start dns server")
+	defer log.Info().Str("host", net.JoinHostPort(t.addr.String(), "53")).Msg("DNS", "stop dns server")
 
-	log.Info().Str("host", t.addr+":53").Msg("DNS", "start dns server")
-	defer log.Info().Str("host", t.addr+":53").Msg("DNS", "stop dns server")
+	handler.routes.exclude(rules.direct())
 
 	for _, protocol := range protocols {
 		if p, ok := protocol.(protocolFixedIPs); ok {
@@ -340,9 +419,15 @@ func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, ipv6
 		}
 	}
 
+	for prefix, protocol := range rules.routes() {
+		handler.routes.add(prefix.String(), protocol)
+	}
+
 	<-ctx.Done()
 
-	if err := sys.DeleteTun(t.name); err != nil {
+	t.routes.flush()
+
+	if err := t.platform.DeleteTun(t.name); err != nil {
 		log.Error().Err(err).Msg("TUN", "delete tun")
 	}
 
@@ -357,128 +442,6 @@ func (t *Service) ListenAndServe(ctx context.Context, protocols []Protocol, ipv6
 	return nil
 }
 
-func (h *tunTransportHandler) handleDNS(ctx context.Context, conn net.Conn) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	defer conn.Close()
-
-	b := make([]byte, 1024)
-
-	n, err := conn.Read(b)
-	if err != nil {
-		log.Warn().Err(err).Msg("DNS", "read msg")
-
-		return
-	}
-
-	b = b[:n]
-
-	msg := new(dns.Msg)
-
-	err = msg.Unpack(b)
-	if err != nil {
-		log.Warn().Err(err).Msg("DNS", "unpack msg")
-
-		return
-	}
-
-	b, err = h.serveDNS(ctx, msg).Pack()
-	if err != nil {
-		log.Debug().Err(err).Msg("DNS", "serve dns")
-
-		return
-	}
-
-	_, err = conn.Write(b)
-	if err != nil {
-		log.Warn().Err(err).Msg("DNS", "write dns")
-
-		return
-	}
-}
-
-func isIPV6Request(req *dns.Msg) bool {
-	for _, q := range req.Question {
-		if q.Qtype == dns.TypeAAAA {
-			return true
-		}
-	}
-	return false
-}
-
-func emptyResponse(req *dns.Msg) *dns.Msg {
-	rsp := new(dns.Msg)
-	rsp.SetReply(req)
-	rsp.Authoritative = true
-	rsp.Rcode = dns.RcodeSuccess
-	return rsp
-}
-
-func (h *tunTransportHandler) serveDNS(ctx context.Context, req *dns.Msg) *dns.Msg {
-	if !h.ipv6 && isIPV6Request(req) {
-		log.Debug().Msg("DNS", "drop ipv6 request")
-
-		return emptyResponse(req)
-	}
-
-	for _, protocol := range h.protocols {
-		var isAllow bool
-
-		for _, domain := range protocol.Domains() {
-			if strings.HasSuffix(req.Question[0].Name, domain+".") {
-				isAllow = true
-			}
-		}
-
-		if !isAllow {
-			continue
-		}
-
-		rsp := protocol.LookupHost(ctx, req.Copy())
-
-		if len(rsp.Answer) == 0 {
-			continue
-		}
-
-		log.Info().DNS(rsp).Msg("DNS", "resolve host")
-
-		if protocol, ok := protocol.(protocolFixedIPs); ok {
-			if len(protocol.FixedIPs()) > 0 {
-				log.Debug().DNS(rsp).Msg("DNS", "use fixed ips")
-
-				return rsp
-			}
-		}
-
-		for _, ans := range rsp.Answer {
-			if a, ok := ans.(*dns.A); ok {
-				h.routes.add(a.A.String(), protocol)
-			}
-		}
-
-		return rsp
-	}
-
-	if h.allDNS {
-		nsList := sys.LGetOriginalDNS()
-
-		if len(nsList) > 0 {
-			cli := new(dns.Client)
-			addr := nsList[0] + ":53"
-
-			res, _, err := cli.ExchangeContext(ctx, req, addr)
-			if err != nil {
-				log.Error().Str("server", addr).DNS(req).Err(err).Msg("DNS", "handle local dns req")
-			}
-
-			return res
-		}
-	}
-
-	return req
-}
-
 // GetRates returns the rates for in and out traffic.
 func (t *Traffic) GetRates() (float64, float64) {
 	in := t.transferredIn.Swap(0)
@@ -533,3 +496,8 @@ func (t *trafficConn) Write(p []byte) (n int, err error) {
 func (t *Service) GetTraffic() *Traffic {
 	return t.traffic
 }
+
+// GetDNSCache returns the DNSCache for this Service.
+func (t *Service) GetDNSCache() *DNSCache {
+	return t.cache
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"net/netip"
+)
+
+// routeTrie is a binary trie of prefixes with longest prefix match lookups.
+type routeTrie struct {
+	v4   *trieNode
+	v6   *trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	prefix   netip.Prefix
+	value    Protocol
+	set      bool
+}
+
+func newRouteTrie() *routeTrie {
+	return &routeTrie{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+}
+
+func (t *routeTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return t.v4
+	}
+
+	return t.v6
+}
+
+func bitAt(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// insert stores value for prefix, replacing the previous value if any.
+func (t *routeTrie) insert(prefix netip.Prefix, value Protocol) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	raw := addr.AsSlice()
+	node := t.root(addr)
+
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bitAt(raw, i)
+
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+
+		node = node.children[bit]
+	}
+
+	if !node.set {
+		t.size++
+	}
+
+	node.prefix = prefix
+	node.value = value
+	node.set = true
+}
+
+// delete removes prefix and reports whether it was present.
+func (t *routeTrie) delete(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	raw := addr.AsSlice()
+	node := t.root(addr)
+	path := make([]*trieNode, 0, prefix.Bits()+1)
+	path = append(path, node)
+
+	for i := 0; i < prefix.Bits(); i++ {
+		node = node.children[bitAt(raw, i)]
+		if node == nil {
+			return false
+		}
+
+		path = append(path, node)
+	}
+
+	if !node.set {
+		return false
+	}
+
+	node.set = false
+	node.value = nil
+	t.size--
+
+	// Prune the branch that no longer leads to any prefix.
+	for i := len(path) - 1; i > 0; i-- {
+		n := path[i]
+		if n.set || n.children[0] != nil || n.children[1] != nil {
+			break
+		}
+
+		path[i-1].children[bitAt(raw, i-1)] = nil
+	}
+
+	return true
+}
+
+// lookup returns the longest prefix containing addr.
+func (t *routeTrie) lookup(addr netip.Addr) (netip.Prefix, Protocol, bool) {
+	addr = addr.Unmap()
+	raw := addr.AsSlice()
+	node := t.root(addr)
+
+	var match *trieNode
+
+	for i := 0; node != nil; i++ {
+		if node.set {
+			match = node
+		}
+
+		if i == addr.BitLen() {
+			break
+		}
+
+		node = node.children[bitAt(raw, i)]
+	}
+
+	if match == nil {
+		return netip.Prefix{}, nil, false
+	}
+
+	return match.prefix, match.value, true
+}
+
+// get returns the value stored for exactly prefix.
+func (t *routeTrie) get(prefix netip.Prefix) (Protocol, bool) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr()
+	raw := addr.AsSlice()
+	node := t.root(addr)
+
+	for i := 0; i < prefix.Bits() && node != nil; i++ {
+		node = node.children[bitAt(raw, i)]
+	}
+
+	if node == nil || !node.set {
+		return nil, false
+	}
+
+	return node.value, true
+}
+
+// walk calls fn for every stored prefix.
+func (t *routeTrie) walk(fn func(netip.Prefix, Protocol)) {
+	var visit func(n *trieNode)
+
+	visit = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+
+		if n.set {
+			fn(n.prefix, n.value)
+		}
+
+		visit(n.children[0])
+		visit(n.children[1])
+	}
+
+	visit(t.v4)
+	visit(t.v6)
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net/netip"
+	"testing"
+)
+
+func TestRouteTrieLookup(t *testing.T) {
+	a, b, c, d := &fakeProtocol{name: "a"}, &fakeProtocol{name: "b"}, &fakeProtocol{name: "c"}, &fakeProtocol{name: "d"}
+
+	trie := newRouteTrie()
+	trie.insert(netip.MustParsePrefix("0.0.0.0/0"), a)
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"), b)
+	trie.insert(netip.MustParsePrefix("10.1.0.0/16"), c)
+	trie.insert(netip.MustParsePrefix("10.1.2.3/32"), d)
+	trie.insert(netip.MustParsePrefix("2001:db8::/32"), b)
+	trie.insert(netip.MustParsePrefix("2001:db8:1::/48"), c)
+	trie.insert(netip.MustParsePrefix("2001:db8:1::1/128"), d)
+
+	tests := []struct {
+		addr   string
+		prefix string
+		value  Protocol
+	}{
+		{"192.0.2.1", "0.0.0.0/0", a},
+		{"10.200.0.1", "10.0.0.0/8", b},
+		{"10.1.200.1", "10.1.0.0/16", c},
+		{"10.1.2.3", "10.1.2.3/32", d},
+		{"10.1.2.4", "10.1.0.0/16", c},
+		{"::ffff:10.1.2.3", "10.1.2.3/32", d},
+		{"2001:db8:2::1", "2001:db8::/32", b},
+		{"2001:db8:1::2", "2001:db8:1::/48", c},
+		{"2001:db8:1::1", "2001:db8:1::1/128", d},
+		{"2001:db9::1", "", nil},
+	}
+
+	for _, tt := range tests {
+		prefix, value, ok := trie.lookup(netip.MustParseAddr(tt.addr))
+		if tt.value == nil {
+			if ok {
+				t.Errorf("lookup %s: got %s, want no match", tt.addr, prefix)
+			}
+
+			continue
+		}
+
+		if !ok || prefix.String() != tt.prefix || value != tt.value {
+			t.Errorf("lookup %s: got %s %v %v, want %s %v", tt.addr, prefix, value, ok, tt.prefix, tt.value)
+		}
+	}
+
+	if trie.size != 7 {
+		t.Errorf("size: got %d, want 7", trie.size)
+	}
+}
+
+func TestRouteTrieInsertReplaces(t *testing.T) {
+	a, b := &fakeProtocol{name: "a"}, &fakeProtocol{name: "b"}
+
+	trie := newRouteTrie()
+	trie.insert(netip.MustParsePrefix("10.1.2.3/8"), a)
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"), b)
+
+	if value, ok := trie.get(netip.MustParsePrefix("10.0.0.0/8")); !ok || value != b {
+		t.Fatalf("get: got %v %v, want b", value, ok)
+	}
+
+	if trie.size != 1 {
+		t.Fatalf("size: got %d, want 1", trie.size)
+	}
+}
+
+func TestRouteTrieDelete(t *testing.T) {
+	a, b := &fakeProtocol{name: "a"}, &fakeProtocol{name: "b"}
+
+	trie := newRouteTrie()
+	trie.insert(netip.MustParsePrefix("10.0.0.0/8"), a)
+	trie.insert(netip.MustParsePrefix("10.1.2.3/32"), b)
+	trie.insert(netip.MustParsePrefix("::/0"), a)
+	trie.insert(netip.MustParsePrefix("2001:db8::1/128"), b)
+
+	if trie.delete(netip.MustParsePrefix("10.1.0.0/16")) {
+		t.Fatal("delete of a missing prefix reported success")
+	}
+
+	if !trie.delete(netip.MustParsePrefix("10.1.2.3/32")) {
+		t.Fatal("delete 10.1.2.3/32 failed")
+	}
+
+	// The nested prefix is gone, the covering one still matches.
+	if prefix, value, ok := trie.lookup(netip.MustParseAddr("10.1.2.3")); !ok || prefix.String() != "10.0.0.0/8" || value != a {
+		t.Fatalf("lookup after delete: got %s %v %v", prefix, value, ok)
+	}
+
+	// The branch below 10.0.0.0/8 was pruned.
+	node := trie.v4
+	for i := 0; i < 8; i++ {
+		node = node.children[bitAt([]byte{10}, i)]
+	}
+
+	if node.children[0] != nil || node.children[1] != nil {
+		t.Fatal("branch of the deleted prefix was not pruned")
+	}
+
+	if !trie.delete(netip.MustParsePrefix("2001:db8::1/128")) {
+		t.Fatal("delete 2001:db8::1/128 failed")
+	}
+
+	if prefix, _, ok := trie.lookup(netip.MustParseAddr("2001:db8::1")); !ok || prefix.String() != "::/0" {
+		t.Fatalf("lookup after delete: got %s %v", prefix, ok)
+	}
+
+	if trie.v6.children[0] != nil || trie.v6.children[1] != nil {
+		t.Fatal("branch of the deleted prefix was not pruned")
+	}
+
+	if !trie.delete(netip.MustParsePrefix("::/0")) || !trie.delete(netip.MustParsePrefix("10.0.0.0/8")) {
+		t.Fatal("delete of the remaining prefixes failed")
+	}
+
+	if _, _, ok := trie.lookup(netip.MustParseAddr("10.1.2.3")); ok {
+		t.Fatal("lookup in an empty trie matched")
+	}
+
+	if trie.size != 0 || trie.v4.children[0] != nil || trie.v4.children[1] != nil {
+		t.Fatalf("trie is not empty: size %d", trie.size)
+	}
+
+	var walked int
+
+	trie.walk(func(netip.Prefix, Protocol) { walked++ })
+
+	if walked != 0 {
+		t.Fatalf("walk of an empty trie visited %d prefixes", walked)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	p := &fakeProtocol{name: "p"}
+	rnd := rand.New(rand.NewSource(1))
+
+	trie := newRouteTrie()
+
+	for i := 0; i < 100_000; i++ {
+		var raw [4]byte
+
+		binary.BigEndian.PutUint32(raw[:], rnd.Uint32())
+
+		trie.insert(netip.PrefixFrom(netip.AddrFrom4(raw), 8+rnd.Intn(25)), p)
+	}
+
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		var raw [4]byte
+
+		binary.BigEndian.PutUint32(raw[:], rnd.Uint32())
+
+		addrs[i] = netip.AddrFrom4(raw)
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		trie.lookup(addrs[i%len(addrs)])
+	}
+}
@@ -0,0 +1,205 @@
+package fakeip
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of synthetic answers, a mapping lives until its address is handed out again
+// but not before the last answer with it expired.
+const TTL = 60
+
+var (
+	errPrefix    = errors.New("fake ip range must be an ipv4 prefix with at least 4 addresses")
+	errExhausted = errors.New("every fake ip has an open flow or a live answer")
+)
+
+// Pool hands out addresses of a reserved IPv4 range to domain names, so traffic
+// to a name can be routed before anyone resolved it. Once the range is exhausted
+// the least recently used address without open flows and answers is handed out again.
+type Pool struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	size   uint32
+	next   uint32
+	names  map[netip.Addr]*list.Element
+	addrs  map[string]*list.Element
+	recent *list.List
+	now    func() time.Time
+	mx     sync.Mutex
+}
+
+type mapping struct {
+	addr     netip.Addr
+	name     string
+	flows    int
+	answered time.Time
+}
+
+// New returns a pool of the addresses of prefix, without its network and broadcast addresses.
+func New(prefix string) (*Pool, error) {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	p = p.Masked()
+
+	if !p.Addr().Is4() || p.Bits() > 30 {
+		return nil, fmt.Errorf("%w: %s", errPrefix, prefix)
+	}
+
+	return &Pool{
+		prefix: p,
+		first:  p.Addr().Next(),
+		size:   1<<(32-p.Bits()) - 2,
+		names:  make(map[netip.Addr]*list.Element),
+		addrs:  make(map[string]*list.Element),
+		recent: list.New(),
+		now:    time.Now,
+	}, nil
+}
+
+// Prefix returns the range of the pool.
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Contains reports whether addr belongs to the pool.
+func (p *Pool) Contains(addr netip.Addr) bool {
+	return p.prefix.Contains(addr.Unmap())
+}
+
+// Addr returns the address of name, assigning one on first use.
+func (p *Pool) Addr(name string) (netip.Addr, error) {
+	name = normalize(name)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := p.now()
+
+	if e, ok := p.addrs[name]; ok {
+		m := e.Value.(*mapping)
+		m.answered = now
+		p.recent.MoveToFront(e)
+
+		return m.addr, nil
+	}
+
+	if p.next < p.size {
+		first := p.first.As4()
+
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(first[:])+p.next)
+
+		p.next++
+
+		m := &mapping{addr: netip.AddrFrom4(b), name: name, answered: now}
+		e := p.recent.PushFront(m)
+		p.names[m.addr] = e
+		p.addrs[name] = e
+
+		return m.addr, nil
+	}
+
+	// A client may still connect to an address it was answered with until the answer expires.
+	for e := p.recent.Back(); e != nil; e = e.Prev() {
+		m := e.Value.(*mapping)
+		if m.flows != 0 || now.Sub(m.answered) < TTL*time.Second {
+			continue
+		}
+
+		delete(p.addrs, m.name)
+
+		m.name = name
+		m.answered = now
+		p.addrs[name] = e
+		p.recent.MoveToFront(e)
+
+		return m.addr, nil
+	}
+
+	return netip.Addr{}, errExhausted
+}
+
+// Name returns the name addr was handed out to.
+func (p *Pool) Name(addr netip.Addr) (string, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	e, ok := p.names[addr.Unmap()]
+	if !ok {
+		return "", false
+	}
+
+	p.recent.MoveToFront(e)
+
+	return e.Value.(*mapping).name, true
+}
+
+// Open returns the name of addr and keeps addr from being handed out again
+// until the returned func is called for the end of the flow.
+func (p *Pool) Open(addr netip.Addr) (string, func(), bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	e, ok := p.names[addr.Unmap()]
+	if !ok {
+		return "", nil, false
+	}
+
+	m := e.Value.(*mapping)
+	m.flows++
+	p.recent.MoveToFront(e)
+
+	var once sync.Once
+
+	return m.name, func() {
+		once.Do(func() {
+			p.mx.Lock()
+			defer p.mx.Unlock()
+
+			m.flows--
+			p.recent.MoveToFront(e)
+		})
+	}, true
+}
+
+// Answer returns the synthetic response to req: an A record from the pool for
+// A questions and no records for any other type.
+func (p *Pool) Answer(req *dns.Msg) (*dns.Msg, error) {
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+	rsp.Authoritative = true
+
+	for _, q := range req.Question {
+		if q.Qtype != dns.TypeA || q.Qclass != dns.ClassINET {
+			continue
+		}
+
+		addr, err := p.Addr(q.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: TTL},
+			A:   addr.AsSlice(),
+		})
+	}
+
+	return rsp, nil
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
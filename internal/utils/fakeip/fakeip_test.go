@@ -0,0 +1,179 @@
+package fakeip
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustAddr(t *testing.T, p *Pool, name string) netip.Addr {
+	t.Helper()
+
+	addr, err := p.Addr(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return addr
+}
+
+// fakeClock moves the clock of p by hand.
+func fakeClock(p *Pool) func(time.Duration) {
+	now := time.Now()
+
+	p.now = func() time.Time {
+		return now
+	}
+
+	return func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func TestPoolReusesLeastRecentlyUsed(t *testing.T) {
+	p, err := New("198.18.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advance := fakeClock(p)
+	addrs := make(map[string]netip.Addr)
+
+	for _, name := range []string{"a.example", "b.example", "c.example", "d.example", "e.example", "f.example"} {
+		addrs[name] = mustAddr(t, p, name)
+	}
+
+	if got := mustAddr(t, p, "A.example."); got != addrs["a.example"] {
+		t.Fatalf("same name: got %s, want %s", got, addrs["a.example"])
+	}
+
+	// Resolving a and dialing b made c the least recently used.
+	if _, ok := p.Name(addrs["b.example"]); !ok {
+		t.Fatal("no name for b")
+	}
+
+	advance(TTL * time.Second)
+
+	if got := mustAddr(t, p, "g.example"); got != addrs["c.example"] {
+		t.Fatalf("reused %s, want the address of c %s", got, addrs["c.example"])
+	}
+
+	if name, _ := p.Name(addrs["c.example"]); name != "g.example" {
+		t.Fatalf("name of reused address: got %s", name)
+	}
+
+	if got := mustAddr(t, p, "c.example"); got != addrs["d.example"] {
+		t.Fatalf("c came back at %s, want the address of d %s", got, addrs["d.example"])
+	}
+}
+
+func TestPoolKeepsOpenFlows(t *testing.T) {
+	p, err := New("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advance := fakeClock(p)
+	a := mustAddr(t, p, "a.example")
+	b := mustAddr(t, p, "b.example")
+
+	name, release, ok := p.Open(a)
+	if !ok || name != "a.example" {
+		t.Fatalf("open: got %s %v", name, ok)
+	}
+
+	// a is the least recently used but has a flow, b is handed out again.
+	mustAddr(t, p, "b.example")
+	mustAddr(t, p, "a.example")
+	advance(TTL * time.Second)
+
+	if got := mustAddr(t, p, "c.example"); got != b {
+		t.Fatalf("reused %s, want %s", got, b)
+	}
+
+	_, releaseC, _ := p.Open(b)
+
+	if _, err := p.Addr("d.example"); !errors.Is(err, errExhausted) {
+		t.Fatalf("every address open: got %v", err)
+	}
+
+	release()
+	release()
+	releaseC()
+
+	if got := mustAddr(t, p, "d.example"); got != a {
+		t.Fatalf("after release: got %s, want %s", got, a)
+	}
+
+	if name, _ := p.Name(b); name != "c.example" {
+		t.Fatalf("released twice freed another flow, b is %s", name)
+	}
+}
+
+func TestPoolKeepsLiveAnswers(t *testing.T) {
+	p, err := New("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advance := fakeClock(p)
+	a := mustAddr(t, p, "a.example")
+	b := mustAddr(t, p, "b.example")
+
+	if _, err := p.Addr("c.example"); !errors.Is(err, errExhausted) {
+		t.Fatalf("every answer live: got %v", err)
+	}
+
+	// Answering a again keeps it, b expires first.
+	advance(TTL / 2 * time.Second)
+	mustAddr(t, p, "a.example")
+	advance(TTL / 2 * time.Second)
+
+	if got := mustAddr(t, p, "c.example"); got != b {
+		t.Fatalf("reused %s, want %s", got, b)
+	}
+
+	if _, err := p.Addr("d.example"); !errors.Is(err, errExhausted) {
+		t.Fatalf("a answered %s ago: got %v", TTL/2*time.Second, err)
+	}
+
+	advance(TTL / 2 * time.Second)
+
+	if got := mustAddr(t, p, "d.example"); got != a {
+		t.Fatalf("after the answer of a expired: got %s, want %s", got, a)
+	}
+}
+
+func TestPoolAnswer(t *testing.T) {
+	p, err := New("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.", dns.TypeA)
+
+	rsp, err := p.Answer(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != "198.18.0.1" {
+		t.Fatalf("answer: %v", rsp.Answer)
+	}
+
+	_, release, _ := p.Open(mustAddr(t, p, "a.example"))
+	defer release()
+
+	_, releaseB, _ := p.Open(mustAddr(t, p, "b.example"))
+	defer releaseB()
+
+	req.SetQuestion("c.example.", dns.TypeA)
+
+	if _, err := p.Answer(req); !errors.Is(err, errExhausted) {
+		t.Fatalf("exhausted pool: got %v", err)
+	}
+}
@@ -75,12 +75,12 @@ func (e *Event) DNS(m *dns.Msg) *Event {
 	}
 
 	for _, ans := range m.Answer {
-		ansA, ok := ans.(*dns.A)
-		if !ok {
-			continue
+		switch a := ans.(type) {
+		case *dns.A:
+			ips = append(ips, a.A.String())
+		case *dns.AAAA:
+			ips = append(ips, a.AAAA.String())
 		}
-
-		ips = append(ips, ansA.A.String())
 	}
 
 	e = e.Str("names", strings.Join(names, ","))
@@ -0,0 +1,14 @@
+package network
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc opens a connection to addr, directly or through the tunnel of a protocol.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Direct dials addr on the host network.
+func Direct(ctx context.Context, network, addr string) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, network, addr)
+}
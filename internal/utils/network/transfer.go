@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -65,6 +66,14 @@ func Transfer(tag string, conn1, conn2 net.Conn) {
 	wg.Wait()
 }
 
+// Track lists conn among the open pipes, for flows relayed without Transfer,
+// until the returned func is called.
+func Track(tag string, conn net.Conn) func() {
+	_, end := open(tag, conn.LocalAddr(), conn.RemoteAddr())
+
+	return end
+}
+
 func open(tag string, addr1, addr2 net.Addr) (*Pipe, func()) {
 	p := Pipe{
 		tag:    tag,
@@ -120,6 +129,26 @@ func List() []*PipeGroup {
 	return groups
 }
 
+// ActiveAddrs returns the destination addresses of all open pipes.
+func ActiveAddrs() map[netip.Addr]struct{} {
+	addrs := make(map[netip.Addr]struct{})
+
+	openPipes.Range(func(k, _ any) bool {
+		p, ok := k.(*Pipe)
+		if !ok {
+			return true
+		}
+
+		if addrPort, err := netip.ParseAddrPort(p.addr1.String()); err == nil {
+			addrs[addrPort.Addr().Unmap()] = struct{}{}
+		}
+
+		return true
+	})
+
+	return addrs
+}
+
 func universalCopy(proto *atomic.Uint32, conn1, conn2 net.Conn) error {
 	buf := make([]byte, 32*1024)
 	protoDetected := false
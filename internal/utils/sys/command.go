@@ -1,17 +1,23 @@
 package sys
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
+	"strings"
 )
 
-// Command execute command and return output and error.
-func Command(cmd string, agrs ...any) (string, error) {
-	str := fmt.Sprintf(cmd, agrs...)
-
-	out, err := exec.Command("sh", "-c", str).Output()
+// Command executes name with the given arguments and returns its output.
+// Arguments are passed as a vector and never interpreted by a shell.
+func Command(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", str, err)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) != 0 {
+			return "", fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+
+		return "", fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
 	}
 
 	return string(out), nil
@@ -0,0 +1,139 @@
+//go:build darwin
+
+package sys
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalPath is where the Journal of system changes is kept between runs.
+const JournalPath = "/var/db/warp/journal.json"
+
+type platform struct {
+	resolv *resolvHandler
+	mx     sync.Mutex
+}
+
+// New returns the Platform of the running system.
+func New() (Platform, error) {
+	return &platform{}, nil
+}
+
+// CreateTun creates a new TUN device with the given parameters.
+func (*platform) CreateTun(name string, ips []netip.Addr, mtu uint32) error {
+	if err := ValidateIface(name); err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if err := validateAddr(ip); err != nil {
+			return err
+		}
+
+		args := []string{name, "inet", ip.String(), ip.String()}
+		if ip.Is6() {
+			args = []string{name, "inet6", ip.String(), ip.String(), "prefixlen", "128"}
+		}
+
+		if _, err := Command("ifconfig", append(args, "mtu", strconv.FormatUint(uint64(mtu), 10), "up")...); err != nil {
+			return fmt.Errorf("failed to create tun: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteTun deletes the given TUN device.
+func (*platform) DeleteTun(name string) error {
+	if err := ValidateIface(name); err != nil {
+		return err
+	}
+
+	if _, err := Command("ifconfig", name, "down"); err != nil {
+		return fmt.Errorf("failed to delete tun: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAddr removes an address assigned by CreateTun, an address that is
+// already gone counts as deleted.
+func (*platform) DeleteAddr(addr netip.Addr, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validateAddr(addr); err != nil {
+		return err
+	}
+
+	if !hasIface(iface) {
+		return nil
+	}
+
+	family := "inet"
+	if addr.Is6() {
+		family = "inet6"
+	}
+
+	if _, err := Command("ifconfig", iface, family, addr.String(), "-alias"); err != nil {
+		return fmt.Errorf("failed to delete address: %w", err)
+	}
+
+	return nil
+}
+
+// AddRoute adds a new static route with the given parameters.
+func (*platform) AddRoute(destination netip.Prefix, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validatePrefix(destination); err != nil {
+		return err
+	}
+
+	if _, err := Command("route", "-n", "add", "-net", destination.String(), "-iface", iface); err != nil {
+		return fmt.Errorf("failed to add route: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteRoute deletes a static route added by AddRoute, a route that is
+// already gone counts as deleted.
+func (*platform) DeleteRoute(destination netip.Prefix, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validatePrefix(destination); err != nil {
+		return err
+	}
+
+	if !hasIface(iface) {
+		return nil
+	}
+
+	if _, err := Command("route", "-n", "delete", "-net", destination.String(), "-iface", iface); err != nil {
+		if strings.Contains(err.Error(), "not in table") {
+			return nil
+		}
+
+		return fmt.Errorf("failed to delete route: %w", err)
+	}
+
+	return nil
+}
+
+// hasIface reports whether the interface exists, its routes and addresses go away with it.
+func hasIface(name string) bool {
+	_, err := net.InterfaceByName(name)
+
+	return err == nil
+}
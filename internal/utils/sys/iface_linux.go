@@ -0,0 +1,123 @@
+//go:build linux
+
+package sys
+
+import (
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// JournalPath is where the Journal of system changes is kept between runs.
+const JournalPath = "/var/lib/warp/journal.json"
+
+type platform struct {
+	resolv *resolvHandler
+}
+
+// New returns the Platform of the running system.
+func New() (Platform, error) {
+	return &platform{
+		resolv: newResolvHandler(),
+	}, nil
+}
+
+// CreateTun creates a new TUN device with the given parameters.
+func (*platform) CreateTun(name string, ips []netip.Addr, mtu uint32) error {
+	if err := ValidateIface(name); err != nil {
+		return err
+	}
+
+	if err := setLink(name, true, mtu); err != nil {
+		return fmt.Errorf("failed to create tun: %w", err)
+	}
+
+	for _, ip := range ips {
+		if err := validateAddr(ip); err != nil {
+			return err
+		}
+
+		if err := changeAddr(unix.RTM_NEWADDR, ip, name); err != nil {
+			return fmt.Errorf("failed to create tun: %w", err)
+		}
+
+		// Queries to the address must reach the tun stack instead of being answered
+		// by the kernel, so its local route is replaced by one into the device.
+		if err := deleteLocalRoute(ip, name); err != nil {
+			return fmt.Errorf("failed to create tun: %w", err)
+		}
+
+		if err := changeRoute(unix.RTM_NEWROUTE, netip.PrefixFrom(ip, ip.BitLen()), name); err != nil {
+			return fmt.Errorf("failed to create tun: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// DeleteTun deletes the given TUN device.
+func (*platform) DeleteTun(name string) error {
+	if err := ValidateIface(name); err != nil {
+		return err
+	}
+
+	if err := setLink(name, false, 0); err != nil {
+		return fmt.Errorf("failed to delete tun: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAddr removes an address assigned by CreateTun, an address that is
+// already gone counts as deleted.
+func (*platform) DeleteAddr(addr netip.Addr, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validateAddr(addr); err != nil {
+		return err
+	}
+
+	if err := changeAddr(unix.RTM_DELADDR, addr, iface); err != nil {
+		return fmt.Errorf("failed to delete address: %w", err)
+	}
+
+	return nil
+}
+
+// AddRoute adds a new static route with the given parameters.
+func (*platform) AddRoute(destination netip.Prefix, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validatePrefix(destination); err != nil {
+		return err
+	}
+
+	if err := changeRoute(unix.RTM_NEWROUTE, destination, iface); err != nil {
+		return fmt.Errorf("failed to add route: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteRoute deletes a static route added by AddRoute, a route that is
+// already gone counts as deleted.
+func (*platform) DeleteRoute(destination netip.Prefix, iface string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := validatePrefix(destination); err != nil {
+		return err
+	}
+
+	if err := changeRoute(unix.RTM_DELROUTE, destination, iface); err != nil {
+		return fmt.Errorf("failed to delete route: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,358 @@
+package sys
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+const (
+	journalAddr      = "addr"
+	journalRoute     = "route"
+	journalSplitDNS  = "split_dns"
+	journalGlobalDNS = "global_dns"
+)
+
+// journalCompactAfter is the number of forget entries after which the journal
+// file is rewritten, it bounds both the size of the file and the cost of load.
+const journalCompactAfter = 256
+
+var errUnknownChange = errors.New("unknown journal entry")
+
+type change struct {
+	Kind   string       `json:"kind"`
+	Iface  string       `json:"iface"`
+	Prefix netip.Prefix `json:"prefix"`
+	Domain string       `json:"domain,omitempty"`
+	State  DNSState     `json:"state,omitempty"`
+}
+
+// entry is a line of the journal file, it either records a change or forgets
+// the changes it matches.
+type entry struct {
+	change
+	Forget bool `json:"forget,omitempty"`
+}
+
+// Journal is a Platform that records every change it applies to a state file,
+// so the changes can be undone after a crash. Changes are appended to the file
+// as they happen and the file is rewritten by Rollback and once enough changes
+// were forgotten.
+type Journal struct {
+	platform Platform
+	path     string
+	changes  []change
+	forgets  int
+	mx       sync.Mutex
+}
+
+// NewJournal wraps platform and persists its changes at path.
+func NewJournal(platform Platform, path string) *Journal {
+	return &Journal{
+		platform: platform,
+		path:     path,
+	}
+}
+
+// Pending reports whether a journal left by a previous run exists.
+func (j *Journal) Pending() bool {
+	_, err := os.Stat(j.path)
+
+	return err == nil
+}
+
+// Rollback undoes every recorded change, newest first, including the changes
+// recorded by a previous run that did not exit cleanly. Changes that could not
+// be undone are kept in the journal and reported in the error.
+func (j *Journal) Rollback() error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	if len(j.changes) == 0 {
+		changes, err := j.load()
+		if err != nil {
+			return err
+		}
+
+		j.changes = changes
+	}
+
+	var (
+		errs   []error
+		failed []change
+	)
+
+	for i := len(j.changes) - 1; i >= 0; i-- {
+		if err := j.undo(j.changes[i]); err != nil {
+			errs = append(errs, err)
+			failed = append([]change{j.changes[i]}, failed...)
+		}
+	}
+
+	j.changes = failed
+	j.forgets = 0
+
+	if err := j.compact(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (j *Journal) undo(c change) error {
+	switch c.Kind {
+	case journalAddr:
+		return j.platform.DeleteAddr(c.Prefix.Addr(), c.Iface)
+	case journalRoute:
+		return j.platform.DeleteRoute(c.Prefix, c.Iface)
+	case journalSplitDNS:
+		return j.platform.RestoreSplitDNS(c.Iface, c.Domain)
+	case journalGlobalDNS:
+		return j.platform.RestoreGlobalDNS(c.Iface, c.State)
+	default:
+		return fmt.Errorf("%w: %s", errUnknownChange, c.Kind)
+	}
+}
+
+// load replays the journal file, forget entries cost a pass over the changes
+// but there are at most journalCompactAfter of them since the last rewrite.
+func (j *Journal) load() ([]change, error) {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	defer file.Close()
+
+	var changes []change
+
+	dec := json.NewDecoder(file)
+
+	for {
+		var e entry
+
+		if err := dec.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				return changes, nil
+			}
+
+			// A crash in the middle of an append leaves a truncated last line.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return changes, nil
+			}
+
+			return nil, fmt.Errorf("parse journal %s: %w", j.path, err)
+		}
+
+		if e.Forget {
+			changes = slices.DeleteFunc(changes, e.matches)
+		} else {
+			changes = append(changes, e.change)
+		}
+	}
+}
+
+// compact rewrites the journal file with the changes that are left, or removes it.
+func (j *Journal) compact() error {
+	if len(j.changes) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove journal: %w", err)
+		}
+
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+
+	for _, c := range j.changes {
+		if err := enc.Encode(entry{change: c}); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	tmp := j.path + ".tmp"
+
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	return nil
+}
+
+// append adds e to the end of the journal file.
+func (j *Journal) append(e entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o700); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+
+	return nil
+}
+
+func (j *Journal) record(c change) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	j.changes = append(j.changes, c)
+
+	return j.append(entry{change: c})
+}
+
+// forget drops the recorded changes that match c, see entry.matches.
+func (j *Journal) forget(c change) error {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	e := entry{change: c, Forget: true}
+
+	j.changes = slices.DeleteFunc(j.changes, e.matches)
+	j.forgets++
+
+	if j.forgets < journalCompactAfter {
+		return j.append(e)
+	}
+
+	j.forgets = 0
+
+	return j.compact()
+}
+
+// matches reports whether the forget entry e covers c, empty fields of e match anything.
+func (e entry) matches(c change) bool {
+	return e.Kind == c.Kind && e.Iface == c.Iface &&
+		(!e.Prefix.IsValid() || e.Prefix == c.Prefix) &&
+		(e.Domain == "" || e.Domain == c.Domain)
+}
+
+// CreateTun implements Platform.
+func (j *Journal) CreateTun(name string, ips []netip.Addr, mtu uint32) error {
+	if err := j.platform.CreateTun(name, ips, mtu); err != nil {
+		return err
+	}
+
+	for _, ip := range ips {
+		if err := j.record(change{Kind: journalAddr, Iface: name, Prefix: netip.PrefixFrom(ip, ip.BitLen())}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteTun implements Platform, the addresses go away with the device.
+func (j *Journal) DeleteTun(name string) error {
+	if err := j.platform.DeleteTun(name); err != nil {
+		return err
+	}
+
+	return j.forget(change{Kind: journalAddr, Iface: name})
+}
+
+// DeleteAddr implements Platform.
+func (j *Journal) DeleteAddr(addr netip.Addr, iface string) error {
+	if err := j.platform.DeleteAddr(addr, iface); err != nil {
+		return err
+	}
+
+	return j.forget(change{Kind: journalAddr, Iface: iface, Prefix: netip.PrefixFrom(addr, addr.BitLen())})
+}
+
+// AddRoute implements Platform.
+func (j *Journal) AddRoute(destination netip.Prefix, iface string) error {
+	if err := j.platform.AddRoute(destination, iface); err != nil {
+		return err
+	}
+
+	return j.record(change{Kind: journalRoute, Iface: iface, Prefix: destination})
+}
+
+// DeleteRoute implements Platform.
+func (j *Journal) DeleteRoute(destination netip.Prefix, iface string) error {
+	if err := j.platform.DeleteRoute(destination, iface); err != nil {
+		return err
+	}
+
+	return j.forget(change{Kind: journalRoute, Iface: iface, Prefix: destination})
+}
+
+// SetSplitDNS implements Platform.
+func (j *Journal) SetSplitDNS(iface string, addr netip.Addr, domain string) error {
+	if err := j.platform.SetSplitDNS(iface, addr, domain); err != nil {
+		return err
+	}
+
+	return j.record(change{Kind: journalSplitDNS, Iface: iface, Domain: domain})
+}
+
+// RestoreSplitDNS implements Platform.
+func (j *Journal) RestoreSplitDNS(iface, domain string) error {
+	if err := j.platform.RestoreSplitDNS(iface, domain); err != nil {
+		return err
+	}
+
+	return j.forget(change{Kind: journalSplitDNS, Iface: iface, Domain: domain})
+}
+
+// SetGlobalDNS implements Platform.
+func (j *Journal) SetGlobalDNS(iface string, servers []netip.Addr) (DNSState, error) {
+	state, err := j.platform.SetGlobalDNS(iface, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, j.record(change{Kind: journalGlobalDNS, Iface: iface, State: state})
+}
+
+// RestoreGlobalDNS implements Platform.
+func (j *Journal) RestoreGlobalDNS(iface string, state DNSState) error {
+	if err := j.platform.RestoreGlobalDNS(iface, state); err != nil {
+		return err
+	}
+
+	return j.forget(change{Kind: journalGlobalDNS, Iface: iface})
+}
+
+// OriginalDNS implements Platform.
+func (j *Journal) OriginalDNS() []string {
+	return j.platform.OriginalDNS()
+}
@@ -0,0 +1,72 @@
+package sys
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// routePlatform accepts route changes and nothing else.
+type routePlatform struct {
+	Platform
+}
+
+func (routePlatform) AddRoute(netip.Prefix, string) error {
+	return nil
+}
+
+func (routePlatform) DeleteRoute(netip.Prefix, string) error {
+	return nil
+}
+
+func TestJournalCompactsForgets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := NewJournal(routePlatform{}, path)
+
+	kept := netip.MustParsePrefix("10.0.0.0/8")
+
+	if err := j.AddRoute(kept, "utun9"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < journalCompactAfter*3+5; i++ {
+		prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte{192, 168, byte(i >> 8), byte(i)}), 32)
+
+		if err := j.AddRoute(prefix, "utun9"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := j.DeleteRoute(prefix, "utun9"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	lines := 0
+
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+
+	// The kept route and the last 5 routes with their forget entries.
+	if lines != 11 {
+		t.Fatalf("journal has %d lines, want 11", lines)
+	}
+
+	changes, err := NewJournal(routePlatform{}, path).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 1 || changes[0].Prefix != kept {
+		t.Fatalf("replayed %v, want only %s", changes, kept)
+	}
+}
@@ -0,0 +1,250 @@
+//go:build linux
+
+package sys
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNetlinkReply = errors.New("unexpected netlink reply")
+
+type netlinkAttr struct {
+	typ  uint16
+	data []byte
+}
+
+// netlinkRequest sends a single rtnetlink request and waits for the kernel acknowledgement.
+func netlinkRequest(typ, flags uint16, body []byte, attrs ...netlinkAttr) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("open netlink socket: %w", err)
+	}
+
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrNetlink{Family: unix.AF_NETLINK}
+
+	if err := unix.Bind(fd, sa); err != nil {
+		return fmt.Errorf("bind netlink socket: %w", err)
+	}
+
+	for _, attr := range attrs {
+		body = appendAttr(body, attr)
+	}
+
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(fd, msg, 0, sa); err != nil {
+		return fmt.Errorf("send netlink request: %w", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return fmt.Errorf("read netlink reply: %w", err)
+	}
+
+	replies, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return fmt.Errorf("parse netlink reply: %w", err)
+	}
+
+	for _, reply := range replies {
+		if reply.Header.Type != unix.NLMSG_ERROR {
+			continue
+		}
+
+		if len(reply.Data) < 4 {
+			return errNetlinkReply
+		}
+
+		if errno := int32(binary.NativeEndian.Uint32(reply.Data[:4])); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+
+		return nil
+	}
+
+	return errNetlinkReply
+}
+
+func appendAttr(b []byte, attr netlinkAttr) []byte {
+	l := unix.SizeofRtAttr + len(attr.data)
+
+	b = binary.NativeEndian.AppendUint16(b, uint16(l))
+	b = binary.NativeEndian.AppendUint16(b, attr.typ)
+	b = append(b, attr.data...)
+
+	for ; l%unix.NLMSG_ALIGNTO != 0; l++ {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// linkIndex returns the index of the interface, the error is ENODEV if there is no such interface.
+func linkIndex(name string) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("open socket: %w", err)
+	}
+
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return 0, fmt.Errorf("lookup interface %s: %w", name, err)
+	}
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, ifr); err != nil {
+		return 0, fmt.Errorf("lookup interface %s: %w", name, err)
+	}
+
+	return int(ifr.Uint32()), nil
+}
+
+// setLink changes the up flag and, if non zero, the MTU of the given interface.
+func setLink(name string, up bool, mtu uint32) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	var flags uint32
+	if up {
+		flags = unix.IFF_UP
+	}
+
+	body := make([]byte, unix.SizeofIfInfomsg)
+	body[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(body[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(body[8:12], flags)
+	binary.NativeEndian.PutUint32(body[12:16], unix.IFF_UP)
+
+	var attrs []netlinkAttr
+	if mtu != 0 {
+		attrs = append(attrs, netlinkAttr{typ: unix.IFLA_MTU, data: binary.NativeEndian.AppendUint32(nil, mtu)})
+	}
+
+	return netlinkRequest(unix.RTM_NEWLINK, 0, body, attrs...)
+}
+
+// changeRoute adds or removes a route to destination through the given interface.
+func changeRoute(typ uint16, destination netip.Prefix, name string) error {
+	return route(typ, destination, name, unix.RT_TABLE_MAIN, unix.RTPROT_STATIC, unix.RT_SCOPE_LINK, unix.RTN_UNICAST)
+}
+
+// deleteLocalRoute removes the route the kernel adds for an address of the
+// interface, so the address is routed into the device like any other.
+func deleteLocalRoute(addr netip.Addr, name string) error {
+	return route(unix.RTM_DELROUTE, netip.PrefixFrom(addr, addr.BitLen()), name, unix.RT_TABLE_LOCAL, 0, unix.RT_SCOPE_HOST, unix.RTN_LOCAL)
+}
+
+func route(typ uint16, destination netip.Prefix, name string, table, proto, scope, kind uint8) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		// The routes of an interface go away with it.
+		if typ == unix.RTM_DELROUTE && errors.Is(err, unix.ENODEV) {
+			return nil
+		}
+
+		return err
+	}
+
+	body := make([]byte, unix.SizeofRtMsg)
+	body[0] = family(destination.Addr())
+	body[1] = uint8(destination.Bits())
+	body[4] = table
+	body[5] = proto
+	body[6] = scope
+	body[7] = kind
+
+	var flags uint16
+	if typ == unix.RTM_NEWROUTE {
+		flags = unix.NLM_F_CREATE | unix.NLM_F_EXCL
+	}
+
+	err = netlinkRequest(typ, flags, body,
+		netlinkAttr{typ: unix.RTA_DST, data: destination.Addr().AsSlice()},
+		netlinkAttr{typ: unix.RTA_OIF, data: binary.NativeEndian.AppendUint32(nil, uint32(index))},
+	)
+	if typ == unix.RTM_NEWROUTE && errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+
+	if typ == unix.RTM_DELROUTE && (errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENODEV)) {
+		return nil
+	}
+
+	return err
+}
+
+// changeAddr adds or removes a single address of the given interface. Added
+// addresses are never picked as the source of outgoing packets: IPv4 ones
+// have host scope and IPv6 ones are deprecated from the start.
+func changeAddr(typ uint16, addr netip.Addr, name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		if typ == unix.RTM_DELADDR && errors.Is(err, unix.ENODEV) {
+			return nil
+		}
+
+		return err
+	}
+
+	body := make([]byte, unix.SizeofIfAddrmsg)
+	body[0] = family(addr)
+	body[1] = uint8(addr.BitLen())
+	body[2] = unix.IFA_F_NODAD
+	body[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(body[4:8], uint32(index))
+
+	attrs := []netlinkAttr{
+		{typ: unix.IFA_LOCAL, data: addr.AsSlice()},
+		{typ: unix.IFA_ADDRESS, data: addr.AsSlice()},
+	}
+
+	var flags uint16
+	if typ == unix.RTM_NEWADDR {
+		flags = unix.NLM_F_CREATE | unix.NLM_F_EXCL
+
+		if addr.Is4() {
+			body[3] = unix.RT_SCOPE_HOST
+		} else {
+			cache := make([]byte, unix.SizeofIfaCacheinfo)
+			binary.NativeEndian.PutUint32(cache[4:8], ^uint32(0))
+			attrs = append(attrs, netlinkAttr{typ: unix.IFA_CACHEINFO, data: cache})
+		}
+	}
+
+	err = netlinkRequest(typ, flags, body, attrs...)
+	if typ == unix.RTM_NEWADDR && errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+
+	if typ == unix.RTM_DELADDR && (errors.Is(err, unix.EADDRNOTAVAIL) || errors.Is(err, unix.ENODEV)) {
+		return nil
+	}
+
+	return err
+}
+
+func family(addr netip.Addr) uint8 {
+	if addr.Is6() {
+		return unix.AF_INET6
+	}
+
+	return unix.AF_INET
+}
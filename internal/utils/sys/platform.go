@@ -0,0 +1,111 @@
+package sys
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+var (
+	errInvalidIface  = errors.New("invalid interface name")
+	errInvalidDomain = errors.New("invalid domain")
+	errInvalidAddr   = errors.New("invalid address")
+)
+
+// Platform applies network configuration to the host system.
+type Platform interface {
+	// CreateTun configures the addresses and MTU of the TUN device and brings it up.
+	CreateTun(name string, ips []netip.Addr, mtu uint32) error
+	// DeleteTun brings the TUN device down.
+	DeleteTun(name string) error
+	// DeleteAddr removes an address assigned by CreateTun.
+	DeleteAddr(addr netip.Addr, iface string) error
+	// AddRoute routes destination through the given interface.
+	AddRoute(destination netip.Prefix, iface string) error
+	// DeleteRoute removes a route previously added with AddRoute.
+	DeleteRoute(destination netip.Prefix, iface string) error
+	// SetSplitDNS sends queries for domain to the nameserver addr.
+	SetSplitDNS(iface string, addr netip.Addr, domain string) error
+	// RestoreSplitDNS removes the nameserver configured for domain.
+	RestoreSplitDNS(iface, domain string) error
+	// SetGlobalDNS makes servers the system wide nameservers and returns the
+	// configuration it replaced.
+	SetGlobalDNS(iface string, servers []netip.Addr) (DNSState, error)
+	// RestoreGlobalDNS puts back the configuration returned by SetGlobalDNS.
+	RestoreGlobalDNS(iface string, state DNSState) error
+	// OriginalDNS returns the system nameservers that were used before warp started.
+	OriginalDNS() []string
+}
+
+// DNSState is an opaque snapshot of the system wide nameserver configuration.
+type DNSState []byte
+
+var (
+	ifaceRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]{0,14}$`)
+	labelRe = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?$`)
+)
+
+// ValidateIface checks that name is a valid network interface name.
+func ValidateIface(name string) error {
+	if !ifaceRe.MatchString(name) {
+		return fmt.Errorf("%w: %q", errInvalidIface, name)
+	}
+
+	return nil
+}
+
+// ValidateDomain checks that domain is a valid DNS name.
+func ValidateDomain(domain string) error {
+	name := strings.TrimSuffix(domain, ".")
+
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("%w: %q", errInvalidDomain, domain)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if !labelRe.MatchString(label) {
+			return fmt.Errorf("%w: %q", errInvalidDomain, domain)
+		}
+	}
+
+	return nil
+}
+
+// ParsePrefix parses a CIDR or a single address into a prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%w: %w", errInvalidAddr, err)
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %w", errInvalidAddr, err)
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func validateAddr(addr netip.Addr) error {
+	if !addr.IsValid() {
+		return errInvalidAddr
+	}
+
+	return nil
+}
+
+func validatePrefix(prefix netip.Prefix) error {
+	if !prefix.IsValid() {
+		return errInvalidAddr
+	}
+
+	return nil
+}
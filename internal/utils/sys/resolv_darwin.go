@@ -0,0 +1,248 @@
+//go:build darwin
+
+package sys
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	errNetworkSetup     = errors.New("network setup failed")
+	errNoNetworkService = errors.New("no service found for interface")
+	errNoDefaultRoute   = errors.New("no default route")
+)
+
+const resolverDir = "/etc/resolver"
+
+type resolvHandler struct {
+	Name       string
+	Device     string
+	DNSServers []string
+	GatewayIP  string
+}
+
+// SetSplitDNS creates a resolver file that sends queries for domain to addr.
+func (*platform) SetSplitDNS(_ string, addr netip.Addr, domain string) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	if err := validateAddr(addr); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(resolverDir, 0o755); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	if err := os.WriteFile(resolverFile(domain), []byte("nameserver "+addr.String()+"\n"), 0o644); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return flushDNSCache()
+}
+
+// RestoreSplitDNS removes the resolver file created for domain.
+func (*platform) RestoreSplitDNS(_, domain string) error {
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	if err := os.Remove(resolverFile(domain)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	return flushDNSCache()
+}
+
+func resolverFile(domain string) string {
+	return filepath.Join(resolverDir, strings.TrimSuffix(domain, "."))
+}
+
+func flushDNSCache() error {
+	if _, err := Command("killall", "-HUP", "mDNSResponder"); err != nil {
+		return fmt.Errorf("failed to flush DNS cache: %w", err)
+	}
+
+	return nil
+}
+
+// SetGlobalDNS replaces the nameservers of the primary network service.
+func (p *platform) SetGlobalDNS(_ string, servers []netip.Addr) (DNSState, error) {
+	r, err := p.handler()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(servers))
+
+	for _, addr := range servers {
+		if err := validateAddr(addr); err != nil {
+			return nil, err
+		}
+
+		list = append(list, addr.String())
+	}
+
+	state, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.SetDNS(list); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// RestoreGlobalDNS puts back the nameservers of the network service saved in state.
+func (*platform) RestoreGlobalDNS(_ string, state DNSState) error {
+	var r resolvHandler
+
+	if err := json.Unmarshal(state, &r); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return r.RestoreDNS()
+}
+
+// OriginalDNS returns the nameservers of the primary network service.
+func (p *platform) OriginalDNS() []string {
+	r, err := p.handler()
+	if err != nil {
+		return nil
+	}
+
+	return r.GetOriginalDNS()
+}
+
+func (p *platform) handler() (*resolvHandler, error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.resolv != nil {
+		return p.resolv, nil
+	}
+
+	r, err := newResolvHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	p.resolv = r
+
+	return r, nil
+}
+
+func newResolvHandler() (*resolvHandler, error) {
+	out, err := Command("route", "-n", "get", "default")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default route: %w", err)
+	}
+
+	var iface, gateway string
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "interface":
+			if iface == "" {
+				iface = strings.TrimSpace(value)
+			}
+		case "gateway":
+			gateway = strings.TrimSpace(value)
+		}
+	}
+
+	if iface == "" {
+		return nil, errNoDefaultRoute
+	}
+
+	network, err := Command("networksetup", "-listnetworkserviceorder")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network services: %w", err)
+	}
+
+	re := regexp.MustCompile(`\((\d+)\) (.+)\n\(Hardware Port: .+, Device: ` + regexp.QuoteMeta(iface) + `\)`)
+
+	networkServices := re.FindStringSubmatch(network)
+	if len(networkServices) == 0 {
+		return nil, fmt.Errorf("%w: %s", errNoNetworkService, iface)
+	}
+
+	networkService := networkServices[2]
+
+	dnsServers, err := getCurrentDNSServers(networkService)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resolvHandler{
+		Name:       networkService,
+		Device:     iface,
+		DNSServers: dnsServers,
+		GatewayIP:  gateway,
+	}, nil
+}
+
+func getCurrentDNSServers(serviceName string) ([]string, error) {
+	out, err := Command("networksetup", "-getdnsservers", serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DNS servers: %w", err)
+	}
+
+	if strings.Contains(out, "There aren't any DNS Servers set") {
+		return nil, nil
+	}
+
+	return strings.Fields(out), nil
+}
+
+func (r *resolvHandler) SetDNS(dns []string) error {
+	args := []string{"-setdnsservers", r.Name}
+	if len(dns) == 0 {
+		args = append(args, "Empty")
+	} else {
+		args = append(args, dns...)
+	}
+
+	if _, err := Command("networksetup", args...); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return flushDNSCache()
+}
+
+func (r *resolvHandler) GetOriginalDNS() []string {
+	if len(r.DNSServers) == 0 {
+		return []string{r.GatewayIP}
+	}
+
+	return r.DNSServers
+}
+
+func (r *resolvHandler) RestoreDNS() error {
+	var result []string
+	for _, elem := range r.DNSServers {
+		if elem != r.GatewayIP {
+			result = append(result, elem)
+		}
+	}
+	return r.SetDNS(result)
+}
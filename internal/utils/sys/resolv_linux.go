@@ -0,0 +1,304 @@
+//go:build linux
+
+package sys
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var (
+	errNetworkSetup    = errors.New("network setup failed")
+	errSplitDNSMissing = errors.New("per-domain dns requires systemd-resolved, enable serve_dns instead")
+)
+
+const (
+	resolvConf        = "/etc/resolv.conf"
+	resolvedConf      = "/run/systemd/resolve/resolv.conf"
+	resolvedRuntimeFS = "/run/systemd/resolve"
+)
+
+type resolvHandler struct {
+	domains    map[string]netip.Addr
+	resolved   bool
+	DNSServers []string
+	loaded     bool
+	mx         sync.Mutex
+}
+
+func newResolvHandler() *resolvHandler {
+	return &resolvHandler{
+		domains:  make(map[string]netip.Addr),
+		resolved: hasResolved(),
+	}
+}
+
+// hasResolved reports whether systemd-resolved manages name resolution on this host.
+func hasResolved() bool {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return false
+	}
+
+	if _, err := os.Stat(resolvedRuntimeFS); err != nil {
+		return false
+	}
+
+	return true
+}
+
+func readNameservers(path string) []string {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var servers []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	return servers
+}
+
+func resolvectl(args ...string) error {
+	if _, err := Command("resolvectl", args...); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return nil
+}
+
+// applyLink pushes the nameservers and the routing domains of the link to systemd-resolved.
+func (r *resolvHandler) applyLink(link string, servers []netip.Addr, domains []string) error {
+	args := []string{"dns", link}
+	for _, addr := range servers {
+		args = append(args, addr.String())
+	}
+
+	if err := resolvectl(args...); err != nil {
+		return err
+	}
+
+	args = []string{"domain", link}
+	for _, domain := range domains {
+		args = append(args, "~"+domain)
+	}
+
+	if err := resolvectl(args...); err != nil {
+		return err
+	}
+
+	return r.flushDNSCache()
+}
+
+func (r *resolvHandler) revertLink(link string) error {
+	if _, err := linkIndex(link); err != nil {
+		// The link is gone together with everything resolved knew about it.
+		return nil
+	}
+
+	if err := resolvectl("revert", link); err != nil {
+		return err
+	}
+
+	return r.flushDNSCache()
+}
+
+func (r *resolvHandler) flushDNSCache() error {
+	if !r.resolved {
+		return nil
+	}
+
+	if err := resolvectl("flush-caches"); err != nil {
+		return fmt.Errorf("failed to flush DNS cache: %w", err)
+	}
+
+	return nil
+}
+
+// SetSplitDNS routes queries for domain to the nameserver addr through the tun link.
+func (p *platform) SetSplitDNS(iface string, addr netip.Addr, domain string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	if err := validateAddr(addr); err != nil {
+		return err
+	}
+
+	r := p.resolv
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if !r.resolved {
+		return fmt.Errorf("%w: %w", errNetworkSetup, errSplitDNSMissing)
+	}
+
+	r.domains[strings.TrimSuffix(domain, ".")] = addr
+
+	return r.applySplit(iface)
+}
+
+// RestoreSplitDNS stops routing queries for domain through the tun link.
+func (p *platform) RestoreSplitDNS(iface, domain string) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	if err := ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	r := p.resolv
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if !r.resolved {
+		return nil
+	}
+
+	delete(r.domains, strings.TrimSuffix(domain, "."))
+
+	if len(r.domains) == 0 {
+		return r.revertLink(iface)
+	}
+
+	return r.applySplit(iface)
+}
+
+func (r *resolvHandler) applySplit(link string) error {
+	var (
+		servers []netip.Addr
+		domains []string
+		seen    = make(map[netip.Addr]bool)
+	)
+
+	for domain, addr := range r.domains {
+		domains = append(domains, domain)
+
+		if !seen[addr] {
+			seen[addr] = true
+			servers = append(servers, addr)
+		}
+	}
+
+	return r.applyLink(link, servers, domains)
+}
+
+// SetGlobalDNS makes servers the default nameservers, through the tun link when
+// systemd-resolved is available or by rewriting resolv.conf otherwise.
+func (p *platform) SetGlobalDNS(iface string, servers []netip.Addr) (DNSState, error) {
+	if err := ValidateIface(iface); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range servers {
+		if err := validateAddr(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	r := p.resolv
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.load()
+
+	if r.resolved {
+		if err := r.applyLink(iface, servers, []string{"."}); err != nil {
+			return nil, err
+		}
+
+		return nil, resolvectl("default-route", iface, "true")
+	}
+
+	backup, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	var conf strings.Builder
+
+	conf.WriteString("# generated by warp, original configuration is restored on exit\n")
+
+	for _, addr := range servers {
+		conf.WriteString("nameserver " + addr.String() + "\n")
+	}
+
+	if err := os.WriteFile(resolvConf, []byte(conf.String()), 0o644); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return backup, nil
+}
+
+// RestoreGlobalDNS puts back the default nameservers, state holds the original
+// resolv.conf when systemd-resolved is not used.
+func (p *platform) RestoreGlobalDNS(iface string, state DNSState) error {
+	if err := ValidateIface(iface); err != nil {
+		return err
+	}
+
+	r := p.resolv
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.resolved {
+		return r.revertLink(iface)
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	if err := os.WriteFile(resolvConf, state, 0o644); err != nil {
+		return fmt.Errorf("%w: %w", errNetworkSetup, err)
+	}
+
+	return nil
+}
+
+// OriginalDNS returns the nameservers that were used before warp started.
+func (p *platform) OriginalDNS() []string {
+	p.resolv.mx.Lock()
+	defer p.resolv.mx.Unlock()
+
+	p.resolv.load()
+
+	return p.resolv.DNSServers
+}
+
+// load reads the system nameservers once, before warp replaces them.
+func (r *resolvHandler) load() {
+	if r.loaded {
+		return
+	}
+
+	conf := resolvConf
+	if r.resolved {
+		conf = resolvedConf
+	}
+
+	r.DNSServers = readNameservers(conf)
+	r.loaded = true
+}
@@ -0,0 +1,149 @@
+package tlsconf
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+const pinPrefix = "sha256//"
+
+var (
+	errCA      = errors.New("no certificates in ca bundle")
+	errKeyPair = errors.New("cert and key must be set together")
+	errPin     = errors.New("server certificate does not match pinned key")
+	errPinHash = errors.New("pin must be a base64 sha256 hash of the public key")
+)
+
+// Config is the tls block of a protocol, it wraps the connection to the server in TLS.
+type Config struct {
+	ServerName string   `yaml:"server_name"`
+	CA         string   `yaml:"ca"`
+	Cert       string   `yaml:"cert"`
+	Key        string   `yaml:"key"`
+	ALPN       []string `yaml:"alpn"`
+	Pin        string   `yaml:"pin"`
+}
+
+// New returns the client config for the server at addr, the server name
+// defaults to its host and the system roots are used without a CA bundle. A
+// pinned key replaces the chain check unless a CA bundle is set as well.
+func New(cfg *Config, addr string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	c := &tls.Config{
+		ServerName: host,
+		NextProtos: cfg.ALPN,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.ServerName != "" {
+		c.ServerName = cfg.ServerName
+	}
+
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: %s", errCA, cfg.CA)
+		}
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, errKeyPair
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.Pin != "" {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cfg.Pin, pinPrefix))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("%w: %s", errPinHash, cfg.Pin)
+		}
+
+		// Without a CA bundle the pin replaces the chain and name checks, like for
+		// self-signed terminators.
+		c.InsecureSkipVerify = cfg.CA == ""
+		c.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPin(state, pin, cfg.CA != "")
+		}
+	}
+
+	return c, nil
+}
+
+// verifyPin accepts the connection if the server certificate has the pinned
+// public key, or any certificate of a verified chain does. Certificates sent
+// along with an unverified one prove nothing, anyone can append them.
+func verifyPin(state tls.ConnectionState, pin []byte, verified bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errPin
+	}
+
+	certs := state.PeerCertificates[:1]
+
+	if verified {
+		certs = nil
+
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if string(sum[:]) == string(pin) {
+			return nil
+		}
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+
+	return fmt.Errorf("%w: server has %s%s", errPin, pinPrefix, base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// Dial connects to addr over TCP with dial and runs the handshake.
+func Dial(ctx context.Context, dial network.DialFunc, addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return Client(ctx, conn, cfg)
+}
+
+// Client runs the handshake over conn, conn is closed if it fails.
+func Client(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, cfg)
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+
+		return nil, fmt.Errorf("tls handshake with %s: %w", cfg.ServerName, err)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,145 @@
+package tlsconf
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert issues a certificate for name signed by parent, or a self-signed one without parent.
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pin() string {
+	sum := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// handshake connects a client with cfg to a server presenting chain, the key of the first certificate.
+func handshake(t *testing.T, cfg *Config, chain ...*testCert) error {
+	t.Helper()
+
+	c, err := New(cfg, "proxy.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := tls.Certificate{PrivateKey: chain[0].key}
+	for _, cert := range chain {
+		served.Certificate = append(served.Certificate, cert.cert.Raw)
+	}
+
+	client, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+
+		_ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{served}, MinVersion: tls.VersionTLS12}).Handshake()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Client(ctx, client, c)
+	if err != nil {
+		return err
+	}
+
+	_ = conn.Close()
+
+	return nil
+}
+
+func TestPin(t *testing.T) {
+	pinned := newCert(t, "proxy.example", nil)
+	mitm := newCert(t, "proxy.example", nil)
+	root := newCert(t, "root", nil)
+	leaf := newCert(t, "proxy.example", root)
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		chain []*testCert
+		err   error
+	}{
+		{"self-signed", Config{Pin: pinned.pin()}, []*testCert{pinned}, nil},
+		{"other key", Config{Pin: pinned.pin()}, []*testCert{mitm}, errPin},
+		{"pinned cert appended", Config{Pin: pinned.pin()}, []*testCert{mitm, pinned}, errPin},
+		{"unverified root", Config{Pin: root.pin()}, []*testCert{leaf, root}, errPin},
+		{"ca leaf", Config{Pin: leaf.pin(), CA: ca}, []*testCert{leaf}, nil},
+		{"ca root", Config{Pin: root.pin(), CA: ca}, []*testCert{leaf}, nil},
+		{"ca pinned cert appended", Config{Pin: pinned.pin(), CA: ca}, []*testCert{leaf, pinned}, errPin},
+	}
+
+	for _, tt := range tests {
+		err := handshake(t, &tt.cfg, tt.chain...)
+
+		if tt.err == nil && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
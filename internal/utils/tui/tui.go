@@ -27,7 +27,7 @@ func (l *LogWriter) Write(p []byte) (n int, err error) {
 }
 
 // CreateTUI creates a TUI for the given service.
-func CreateTUI(routes *service.Routes, traffic *service.Traffic, useFun bool) error {
+func CreateTUI(routes *service.Routes, traffic *service.Traffic, cache *service.DNSCache, useFun bool) error {
 	l := &LogWriter{logs: make(chan string, 100)}
 
 	log.SetOutput(l)
@@ -48,7 +48,7 @@ func CreateTUI(routes *service.Routes, traffic *service.Traffic, useFun bool) er
 	defer g.Close()
 
 	g.SetManagerFunc(func(g *gocui.Gui) error {
-		return layout(g, routes, traffic, l.logs)
+		return layout(g, routes, traffic, cache, l.logs)
 	})
 
 	if err := g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, func(*gocui.Gui, *gocui.View) error {
@@ -64,7 +64,7 @@ func CreateTUI(routes *service.Routes, traffic *service.Traffic, useFun bool) er
 	return nil
 }
 
-func layout(g *gocui.Gui, routes *service.Routes, traffic *service.Traffic, logs <-chan string) error {
+func layout(g *gocui.Gui, routes *service.Routes, traffic *service.Traffic, cache *service.DNSCache, logs <-chan string) error {
 	maxX, maxY := g.Size()
 
 	if v, err := g.SetView("logs", 0, 0, maxX-21, maxY-16); err != nil {
@@ -159,7 +159,30 @@ func layout(g *gocui.Gui, routes *service.Routes, traffic *service.Traffic, logs
 		}()
 	}
 
-	if v, err := g.SetView("ips", maxX-20, 6, maxX-1, maxY-4); err != nil {
+	if v, err := g.SetView("cache", maxX-20, 6, maxX-1, 9); err != nil {
+		if !errors.Is(err, gocui.ErrUnknownView) {
+			return err
+		}
+
+		v.Title = "DNS Cache"
+
+		go func() {
+			for range time.NewTicker(time.Second * 1).C {
+				g.Update(func(*gocui.Gui) error {
+					v.Clear()
+
+					hits, misses := cache.Stats()
+
+					fmt.Fprintf(v, "Hit:  %d\n", hits)
+					fmt.Fprintf(v, "Miss: %d\n", misses)
+
+					return nil
+				})
+			}
+		}()
+	}
+
+	if v, err := g.SetView("ips", maxX-20, 10, maxX-1, maxY-4); err != nil {
 		if !errors.Is(err, gocui.ErrUnknownView) {
 			return err
 		}
@@ -0,0 +1,393 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+var (
+	errScheme   = errors.New("unsupported dns upstream scheme")
+	errNoServer = errors.New("no dns servers configured")
+	errFailed   = errors.New("all dns servers failed")
+	errRcode    = errors.New("dns server answered")
+	errStatus   = errors.New("dns server returned http status")
+	errResolve  = errors.New("no address for dns server")
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	maxMsgSize   = dns.MaxMsgSize
+)
+
+var defaultPorts = map[string]string{
+	"udp":   "53",
+	"tcp":   "53",
+	"tls":   "853",
+	"https": "443",
+}
+
+// DialFunc opens a connection to addr, usually through the tunnel of a protocol.
+type DialFunc = network.DialFunc
+
+// Upstream is a nameserver reached over plain udp or tcp, DNS-over-TLS or DNS-over-HTTPS.
+type Upstream struct {
+	scheme string
+	// addr is dialed, host is verified by TLS, see Resolve.
+	addr   string
+	host   string
+	url    string
+	dial   DialFunc
+	client *http.Client
+	once   sync.Once
+	// roots verifies the server certificate, nil uses the system roots.
+	roots *x509.CertPool
+}
+
+// New parses s as udp://, tcp://, tls:// or https:// URL, a bare address uses network.
+func New(s, network string, dial DialFunc) (*Upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = network + "://" + hostPort(s)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("dns upstream %s: %w", s, err)
+	}
+
+	port, ok := defaultPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errScheme, s)
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	up := &Upstream{
+		scheme: u.Scheme,
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		host:   u.Hostname(),
+		dial:   dial,
+	}
+
+	if u.Scheme == "https" {
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+
+		up.url = u.String()
+	}
+
+	return up, nil
+}
+
+// NewList parses every entry of list with New.
+func NewList(list []string, network string, dial DialFunc) ([]*Upstream, error) {
+	ups := make([]*Upstream, 0, len(list))
+
+	for _, s := range list {
+		up, err := New(s, network, dial)
+		if err != nil {
+			return nil, err
+		}
+
+		ups = append(ups, up)
+	}
+
+	return ups, nil
+}
+
+// hostPort brackets a bare IPv6 address so it can be parsed as URL host.
+func hostPort(s string) string {
+	if addr, err := netip.ParseAddr(s); err == nil && addr.Is6() {
+		return "[" + s + "]"
+	}
+
+	return s
+}
+
+// String returns the upstream in URL form.
+func (u *Upstream) String() string {
+	if u.url != "" {
+		return u.url
+	}
+
+	return u.scheme + "://" + u.addr
+}
+
+// Addr returns the address of the upstream if its host is an IP.
+func (u *Upstream) Addr() (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(u.host)
+
+	return addr, err == nil
+}
+
+// Resolve looks up the host of a named upstream with ups once and dials the
+// address from then on, so the system resolver is not asked for the server of
+// the system resolver. The name is still verified by TLS.
+func (u *Upstream) Resolve(ctx context.Context, ups []*Upstream) error {
+	if _, ok := u.Addr(); ok {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(u.addr)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(u.host), qtype)
+
+		rsp, err := Exchange(ctx, ups, req)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		for _, rr := range rsp.Answer {
+			var ip net.IP
+
+			switch a := rr.(type) {
+			case *dns.A:
+				ip = a.A
+			case *dns.AAAA:
+				ip = a.AAAA
+			default:
+				continue
+			}
+
+			u.addr = net.JoinHostPort(ip.String(), port)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w %s: %w", errResolve, u.host, errors.Join(errs...))
+}
+
+// Exchange asks the upstreams in turn and returns the first usable answer,
+// SERVFAIL and REFUSED answers count as failures.
+func Exchange(ctx context.Context, ups []*Upstream, req *dns.Msg) (*dns.Msg, error) {
+	if len(ups) == 0 {
+		return nil, errNoServer
+	}
+
+	var errs []error
+
+	for _, up := range ups {
+		rsp, err := up.Exchange(ctx, req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", up, err))
+
+			continue
+		}
+
+		return rsp, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", errFailed, errors.Join(errs...))
+}
+
+// Exchange sends req to the upstream and returns its answer.
+func (u *Upstream) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var (
+		rsp *dns.Msg
+		err error
+	)
+
+	switch u.scheme {
+	case "udp":
+		rsp, err = u.exchangeUDP(ctx, req)
+	case "tcp", "tls":
+		rsp, err = u.exchangeStream(ctx, req)
+	default:
+		rsp, err = u.exchangeHTTPS(ctx, req)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Rcode == dns.RcodeServerFailure || rsp.Rcode == dns.RcodeRefused {
+		return nil, fmt.Errorf("%w: %s", errRcode, dns.RcodeToString[rsp.Rcode])
+	}
+
+	return rsp, nil
+}
+
+func (u *Upstream) open(ctx context.Context, network string) (net.Conn, func() bool, error) {
+	conn, err := u.dial(ctx, network, u.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			stop()
+			_ = conn.Close()
+
+			return nil, nil, err
+		}
+	}
+
+	return conn, stop, nil
+}
+
+// exchangeUDP sends req in a single datagram, the tunnel conns are not net.PacketConn
+// so the message is written and read without dns.Conn.
+func (u *Upstream) exchangeUDP(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, stop, err := u.open(ctx, "udp")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stop()
+	defer conn.Close()
+
+	data, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMsgSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		rsp := new(dns.Msg)
+		if err := rsp.Unpack(buf[:n]); err != nil || rsp.Id != req.Id {
+			continue
+		}
+
+		if rsp.Truncated {
+			return u.exchangeStream(ctx, req)
+		}
+
+		return rsp, nil
+	}
+}
+
+func (u *Upstream) exchangeStream(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, stop, err := u.open(ctx, "tcp")
+	if err != nil {
+		return nil, err
+	}
+
+	defer stop()
+	defer conn.Close()
+
+	if u.scheme == "tls" {
+		tlsConn := tls.Client(conn, u.tlsConfig())
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	co := &dns.Conn{Conn: conn}
+
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+
+	return co.ReadMsg()
+}
+
+func (u *Upstream) exchangeHTTPS(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	u.once.Do(func() {
+		u.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:       u.dialAddr,
+				TLSClientConfig:   u.tlsConfig(),
+				ForceAttemptHTTP2: true,
+			},
+		}
+	})
+
+	// RFC 8484 asks for a zero ID to keep the answers cacheable.
+	msg := req.Copy()
+	msg.Id = 0
+
+	data, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	httpRsp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	defer httpRsp.Body.Close()
+
+	if httpRsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errStatus, httpRsp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpRsp.Body, maxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := new(dns.Msg)
+	if err := rsp.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	rsp.Id = req.Id
+
+	return rsp, nil
+}
+
+// dialAddr dials the upstream for the HTTP transport, whatever address the URL has.
+func (u *Upstream) dialAddr(ctx context.Context, network, _ string) (net.Conn, error) {
+	return u.dial(ctx, network, u.addr)
+}
+
+func (u *Upstream) tlsConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: u.host,
+		RootCAs:    u.roots,
+		MinVersion: tls.VersionTLS12,
+	}
+}
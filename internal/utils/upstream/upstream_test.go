@@ -0,0 +1,295 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/merzzzl/warp/internal/utils/network"
+)
+
+var testAnswer = net.ParseIP("192.0.2.7")
+
+// answer replies to a query with rcode, a successful reply carries testAnswer.
+func answer(req *dns.Msg, rcode int) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetRcode(req, rcode)
+
+	if rcode == dns.RcodeSuccess {
+		rsp.Answer = append(rsp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   testAnswer,
+		})
+	}
+
+	return rsp
+}
+
+// startDoH serves DNS-over-HTTPS answers with rcode on 127.0.0.1.
+func startDoH(t *testing.T, rcode int) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil || req.Id != 0 {
+			http.Error(w, "bad message", http.StatusBadRequest)
+
+			return
+		}
+
+		data, err := answer(req, rcode).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(data)
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// startDNS serves answers with rcode on 127.0.0.1 over udp or, with cert, over tcp-tls.
+func startDNS(t *testing.T, rcode int, cert *tls.Certificate) string {
+	t.Helper()
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(answer(req, rcode))
+	})
+
+	started := make(chan struct{})
+	srv := &dns.Server{Handler: handler, NotifyStartedFunc: func() { close(started) }}
+
+	var addr string
+
+	if cert != nil {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv.Listener, addr = l, "tls://"+l.Addr().String()
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv.PacketConn, addr = pc, "udp://"+pc.LocalAddr().String()
+	}
+
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+
+	<-started
+
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+
+	return addr
+}
+
+// newTrusted parses s as an upstream that trusts the certificate of srv.
+func newTrusted(t *testing.T, s string, srv *httptest.Server) *Upstream {
+	t.Helper()
+
+	up, err := New(s, "udp", network.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up.roots = x509.NewCertPool()
+	up.roots.AddCert(srv.Certificate())
+
+	return up
+}
+
+func query() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("db.corp.example.com.", dns.TypeA)
+
+	return req
+}
+
+func checkAnswer(t *testing.T, req, rsp *dns.Msg) {
+	t.Helper()
+
+	if rsp.Id != req.Id || rsp.Rcode != dns.RcodeSuccess || len(rsp.Answer) != 1 {
+		t.Fatalf("unexpected answer: %v", rsp)
+	}
+
+	if a, ok := rsp.Answer[0].(*dns.A); !ok || !a.A.Equal(testAnswer) {
+		t.Fatalf("unexpected answer: %v", rsp.Answer[0])
+	}
+}
+
+func TestExchangeDoH(t *testing.T) {
+	doh := startDoH(t, dns.RcodeSuccess)
+	up := newTrusted(t, doh.URL, doh)
+
+	if up.String() != doh.URL+"/dns-query" {
+		t.Fatalf("url: got %s", up)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := query()
+
+	rsp, err := up.Exchange(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAnswer(t, req, rsp)
+}
+
+func TestExchangeDoT(t *testing.T) {
+	doh := startDoH(t, dns.RcodeSuccess)
+	dot := startDNS(t, dns.RcodeSuccess, &doh.TLS.Certificates[0])
+	up := newTrusted(t, dot, doh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := query()
+
+	rsp, err := up.Exchange(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAnswer(t, req, rsp)
+
+	// Without the test certificate among the roots the server is not trusted.
+	up.roots = x509.NewCertPool()
+
+	if _, err := up.Exchange(ctx, req); err == nil {
+		t.Fatal("exchange with an untrusted server succeeded")
+	}
+}
+
+func TestExchangeFallback(t *testing.T) {
+	refused := startDoH(t, dns.RcodeRefused)
+	servfail := startDNS(t, dns.RcodeServerFailure, &refused.TLS.Certificates[0])
+	good := startDNS(t, dns.RcodeSuccess, nil)
+
+	ups := []*Upstream{
+		newTrusted(t, servfail, refused),
+		newTrusted(t, refused.URL, refused),
+		newTrusted(t, good, refused),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := query()
+
+	rsp, err := Exchange(ctx, ups, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAnswer(t, req, rsp)
+
+	_, err = Exchange(ctx, ups[:2], req)
+	if !errors.Is(err, errFailed) || !errors.Is(err, errRcode) {
+		t.Fatalf("exchange with failing servers: got %v", err)
+	}
+
+	if _, err := Exchange(ctx, nil, req); !errors.Is(err, errNoServer) {
+		t.Fatalf("exchange without servers: got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	doh := startDoH(t, dns.RcodeSuccess)
+	resolver, err := New(startDNS(t, dns.RcodeSuccess, nil), "udp", network.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, err := net.SplitHostPort(doh.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dialed []string
+
+	// The resolver answers testAnswer, the dial goes to the test server instead.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+
+		return new(net.Dialer).DialContext(ctx, network, doh.Listener.Addr().String())
+	}
+
+	// The certificate of the test server is valid for example.com.
+	up := newTrusted(t, "https://example.com:"+port, doh)
+	up.dial = dial
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := up.Resolve(ctx, []*Upstream{resolver}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := query()
+
+	rsp, err := up.Exchange(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkAnswer(t, req, rsp)
+
+	if want := net.JoinHostPort(testAnswer.String(), port); len(dialed) != 1 || dialed[0] != want {
+		t.Fatalf("dialed %v, want %s", dialed, want)
+	}
+
+	if up.String() != "https://example.com:"+port+"/dns-query" {
+		t.Fatalf("url: got %s", up)
+	}
+
+	// Upstreams with an address are not resolved.
+	if err := resolver.Resolve(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	named, err := New("tls://dns.example", "udp", network.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := named.Resolve(ctx, nil); !errors.Is(err, errResolve) || !errors.Is(err, errNoServer) {
+		t.Fatalf("resolve without servers: got %v", err)
+	}
+}